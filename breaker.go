@@ -0,0 +1,83 @@
+// Copyright 2023 chengyayu. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpcpool
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	circuitClosed = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// breaker is the circuit breaker around dialing.
+type breaker struct {
+	mu sync.Mutex
+	// state is one of circuitClosed, circuitOpen and circuitHalfOpen.
+	state int
+	// failures is the number of consecutive failed dials.
+	failures int
+	// openedAt is when the circuit opened last time.
+	openedAt time.Time
+}
+
+// allow reports ErrCircuitOpen if the dial should fail fast. After the open window,
+// only a single probe dial is allowed until its result is reported by done.
+func (b *breaker) allow(o *options) error {
+	if o.breakerThreshold == 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case circuitOpen:
+		if time.Since(b.openedAt) < o.breakerTimeout {
+			return ErrCircuitOpen
+		}
+		// 半开：放行一次探测拨号
+		b.state = circuitHalfOpen
+		return nil
+	case circuitHalfOpen:
+		return ErrCircuitOpen
+	}
+	return nil
+}
+
+// done reports the result of an allowed dial.
+func (b *breaker) done(o *options, err error) {
+	if o.breakerThreshold == 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		b.state, b.failures = circuitClosed, 0
+		return
+	}
+	b.failures++
+	if b.state == circuitHalfOpen || b.failures >= o.breakerThreshold {
+		b.state, b.openedAt = circuitOpen, time.Now()
+	}
+}
+
+// open reports whether the dials fail fast now.
+func (b *breaker) open() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state != circuitClosed
+}
@@ -0,0 +1,70 @@
+// Copyright 2023 chengyayu. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpcpool
+
+import (
+	"errors"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	var dials, down int32 = 0, 1
+	dial := Dial(func(address string) (*grpc.ClientConn, error) {
+		atomic.AddInt32(&dials, 1)
+		if atomic.LoadInt32(&down) == 1 {
+			return nil, errors.New("connection refused")
+		}
+		return DialTest(address)
+	})
+
+	_, err := New(*endpoint, dial, CircuitBreaker(2, 0))
+	require.Error(t, err)
+
+	p, err := New(*endpoint, dial, MaxIdle(1), Lazy(true), CircuitBreaker(2, 50*time.Millisecond))
+	require.NoError(t, err)
+	defer p.Close()
+
+	// the circuit opens after 2 consecutive failures, then fails fast without dialing.
+	for i := 0; i < 2; i++ {
+		_, err = p.Get()
+		require.Error(t, err)
+		require.NotErrorIs(t, err, ErrCircuitOpen)
+	}
+	_, err = p.Get()
+	require.ErrorIs(t, err, ErrCircuitOpen)
+	require.EqualValues(t, 2, atomic.LoadInt32(&dials))
+	require.True(t, p.Stats().CircuitOpen)
+	require.Zero(t, p.Stats().Ref)
+
+	// a failed probe opens it again.
+	time.Sleep(60 * time.Millisecond)
+	_, err = p.Get()
+	require.NotErrorIs(t, err, ErrCircuitOpen)
+	require.EqualValues(t, 3, atomic.LoadInt32(&dials))
+	_, err = p.Get()
+	require.ErrorIs(t, err, ErrCircuitOpen)
+
+	// a successful probe closes it.
+	atomic.StoreInt32(&down, 0)
+	time.Sleep(60 * time.Millisecond)
+	conn, err := p.Get()
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+	require.False(t, p.Stats().CircuitOpen)
+}
@@ -0,0 +1,547 @@
+// Copyright 2023 chengyayu. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpcpool
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// EnvPrefix is the prefix of the environment variables LoadConfig reads.
+// The variable of a field is the prefix followed by its json name in upper snake case,
+// e.g. GRPCPOOL_MAX_IDLE and GRPCPOOL_DIAL_TLS_CA_FILE.
+const EnvPrefix = "GRPCPOOL_"
+
+// Duration is a time.Duration read from strings like "1.5s" or "300ms".
+type Duration time.Duration
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// Config is the file form of the pool options, see the option of the same name for each field.
+// Start from DefaultConfig, or use LoadConfig which does.
+type Config struct {
+	Address              string   `json:"address" yaml:"address"`
+	MaxIdle              int      `json:"maxIdle" yaml:"maxIdle"`
+	MinIdle              int      `json:"minIdle" yaml:"minIdle"`
+	Lazy                 bool     `json:"lazy" yaml:"lazy"`
+	MaxActive            int      `json:"maxActive" yaml:"maxActive"`
+	UnlimitedCap         int      `json:"unlimitedCap" yaml:"unlimitedCap"`
+	MaxConcurrentStreams int      `json:"maxConcurrentStreams" yaml:"maxConcurrentStreams"`
+	Reuse                bool     `json:"reuse" yaml:"reuse"`
+	DialConcurrency      int      `json:"dialConcurrency" yaml:"dialConcurrency"`
+	MinStart             int      `json:"minStart" yaml:"minStart"`
+	FillBackoff          Duration `json:"fillBackoff" yaml:"fillBackoff"`
+	FillMaxBackoff       Duration `json:"fillMaxBackoff" yaml:"fillMaxBackoff"`
+	AsyncGrowth          float64  `json:"asyncGrowth" yaml:"asyncGrowth"`
+	MaintainInterval     Duration `json:"maintainInterval" yaml:"maintainInterval"`
+	AdaptiveStreams      float64  `json:"adaptiveStreams" yaml:"adaptiveStreams"`
+
+	MaxOneShot int     `json:"maxOneShot" yaml:"maxOneShot"`
+	DialRate   float64 `json:"dialRate" yaml:"dialRate"`
+	DialBurst  int     `json:"dialBurst" yaml:"dialBurst"`
+
+	// CircuitBreakerThreshold and CircuitBreakerTimeout configure CircuitBreaker.
+	CircuitBreakerThreshold int      `json:"circuitBreakerThreshold" yaml:"circuitBreakerThreshold"`
+	CircuitBreakerTimeout   Duration `json:"circuitBreakerTimeout" yaml:"circuitBreakerTimeout"`
+
+	// Strict panics on the misuses of the pool, see Strict.
+	Strict bool `json:"strict" yaml:"strict"`
+
+	// Block, MaxWaiting and WaitOrder configure the blocking mode, WaitOrder is one of "fifo" and "lifo".
+	Block      bool   `json:"block" yaml:"block"`
+	MaxWaiting int    `json:"maxWaiting" yaml:"maxWaiting"`
+	WaitOrder  string `json:"waitOrder" yaml:"waitOrder"`
+
+	// Shards configures Shards, it can't be changed by reloading.
+	Shards int `json:"shards" yaml:"shards"`
+
+	// GrowthPolicy is one of "double", "linear" and "percent", GrowthStep is the step or the percent.
+	GrowthPolicy string `json:"growthPolicy" yaml:"growthPolicy"`
+	GrowthStep   int    `json:"growthStep" yaml:"growthStep"`
+
+	// ShrinkPolicy is one of "maxIdle", "stepDown", "lru" and "oldest", ShrinkStep is the step of "stepDown".
+	ShrinkPolicy string `json:"shrinkPolicy" yaml:"shrinkPolicy"`
+	ShrinkStep   int    `json:"shrinkStep" yaml:"shrinkStep"`
+
+	// PickPolicy is one of "roundRobin", "leastLoaded" and "fastest".
+	PickPolicy string `json:"pickPolicy" yaml:"pickPolicy"`
+
+	// OutlierDetection enables DetectOutliers when set.
+	OutlierDetection *OutlierSettings `json:"outlierDetection" yaml:"outlierDetection"`
+
+	Dial DialSettings `json:"dial" yaml:"dial"`
+}
+
+// OutlierSettings is the file form of OutlierDetection, see the field of the same name for each field.
+// The zero fields take the values of DefaultOutlierDetection.
+type OutlierSettings struct {
+	ErrorRate         float64  `json:"errorRate" yaml:"errorRate"`
+	MinRequests       int      `json:"minRequests" yaml:"minRequests"`
+	BaseEjection      Duration `json:"baseEjection" yaml:"baseEjection"`
+	MaxEjection       Duration `json:"maxEjection" yaml:"maxEjection"`
+	MaxEjections      int      `json:"maxEjections" yaml:"maxEjections"`
+	MaxEjectedPercent int      `json:"maxEjectedPercent" yaml:"maxEjectedPercent"`
+}
+
+// DialSettings is the file form of DialConfig, see the field of the same name for each field.
+// Insecure is true by default, set it false when TLS is set.
+type DialSettings struct {
+	Timeout               Duration   `json:"timeout" yaml:"timeout"`
+	BackoffMaxDelay       Duration   `json:"backoffMaxDelay" yaml:"backoffMaxDelay"`
+	TLS                   *TLSConfig `json:"tls" yaml:"tls"`
+	Insecure              bool       `json:"insecure" yaml:"insecure"`
+	KeepAliveTime         Duration   `json:"keepAliveTime" yaml:"keepAliveTime"`
+	KeepAliveTimeout      Duration   `json:"keepAliveTimeout" yaml:"keepAliveTimeout"`
+	PermitWithoutStream   bool       `json:"permitWithoutStream" yaml:"permitWithoutStream"`
+	InitialWindowSize     int32      `json:"initialWindowSize" yaml:"initialWindowSize"`
+	InitialConnWindowSize int32      `json:"initialConnWindowSize" yaml:"initialConnWindowSize"`
+	MaxSendMsgSize        int        `json:"maxSendMsgSize" yaml:"maxSendMsgSize"`
+	MaxRecvMsgSize        int        `json:"maxRecvMsgSize" yaml:"maxRecvMsgSize"`
+	Compressor            string     `json:"compressor" yaml:"compressor"`
+	UserAgent             string     `json:"userAgent" yaml:"userAgent"`
+}
+
+// ConfigErrors are all the problems found in a Config.
+type ConfigErrors []error
+
+func (e ConfigErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Is reports whether any of the problems is target, see errors.Is.
+func (e ConfigErrors) Is(target error) bool {
+	for _, err := range e {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first problem that matches target, see errors.As.
+func (e ConfigErrors) As(target interface{}) bool {
+	for _, err := range e {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// GRPCStatus see status.FromError.
+func (e ConfigErrors) GRPCStatus() *status.Status {
+	return status.New(codes.InvalidArgument, e.Error())
+}
+
+// add appends err if it's not nil, the problems of ConfigErrors one by one.
+func (e *ConfigErrors) add(err error) {
+	var errs ConfigErrors
+	if errors.As(err, &errs) {
+		*e = append(*e, errs...)
+	} else if err != nil {
+		*e = append(*e, err)
+	}
+}
+
+// err returns nil if there is no problem, the problem itself if there is only one.
+func (e ConfigErrors) err() error {
+	switch len(e) {
+	case 0:
+		return nil
+	case 1:
+		return e[0]
+	}
+	return e
+}
+
+// DefaultConfig returns the configuration equal to the default options.
+func DefaultConfig() Config {
+	d := DefaultDialConfig()
+	return Config{
+		MaxIdle:              DftMaxIdle,
+		MaxActive:            DftMaxActive,
+		UnlimitedCap:         DftUnlimitedCap,
+		MaxConcurrentStreams: DftMaxConcurrentStreams,
+		Reuse:                true,
+		DialConcurrency:      DftDialConcurrency,
+		FillBackoff:          Duration(DftFillBackoff),
+		FillMaxBackoff:       Duration(BackoffMaxDelay),
+		MaintainInterval:     Duration(DftMaintainInterval),
+		GrowthPolicy:         "double",
+		ShrinkPolicy:         "maxIdle",
+		PickPolicy:           "roundRobin",
+		WaitOrder:            "fifo",
+		Dial: DialSettings{
+			Timeout:               Duration(d.Timeout),
+			BackoffMaxDelay:       Duration(d.BackoffMaxDelay),
+			Insecure:              d.Insecure,
+			KeepAliveTime:         Duration(d.KeepAliveTime),
+			KeepAliveTimeout:      Duration(d.KeepAliveTimeout),
+			PermitWithoutStream:   d.PermitWithoutStream,
+			InitialWindowSize:     d.InitialWindowSize,
+			InitialConnWindowSize: d.InitialConnWindowSize,
+			MaxSendMsgSize:        d.MaxSendMsgSize,
+			MaxRecvMsgSize:        d.MaxRecvMsgSize,
+		},
+	}
+}
+
+// LoadConfig reads the configuration from the JSON or YAML file at path, chosen by its extension,
+// then overrides it with the GRPCPOOL_* environment variables. The fields missing from both keep
+// the defaults. An empty path reads the environment only. It returns ConfigErrors if any
+// value can't be parsed or the result is invalid.
+func LoadConfig(path string) (*Config, error) {
+	c := DefaultConfig()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		switch ext := strings.ToLower(filepath.Ext(path)); ext {
+		case ".json":
+			err = json.Unmarshal(data, &c)
+		case ".yaml", ".yml":
+			err = yaml.Unmarshal(data, &c)
+		default:
+			err = fmt.Errorf("unsupported config file extension %q", ext)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("load config %s: %w", path, err)
+		}
+	}
+
+	errs := applyEnv(reflect.ValueOf(&c).Elem(), EnvPrefix)
+	if err := c.Validate(); err != nil {
+		errs = append(errs, err.(ConfigErrors)...)
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return &c, nil
+}
+
+// Validate reports every invalid or conflicting setting at once. The settings are checked
+// by the options they convert to, as New does, the names of the policies by the file form.
+func (c Config) Validate() error {
+	opts, errs := c.options()
+	if c.Address == "" {
+		errs = append(errs, configError("address", "must be set"))
+	}
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(o)
+	}
+	errs.add(o.validate())
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Options validates the configuration and converts it to the options of New.
+func (c Config) Options() ([]Option, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	opts, _ := c.options()
+	return opts, nil
+}
+
+// options converts the configuration to the options of New, it reports the unknown names of
+// the policies, they keep the defaults in the options.
+func (c Config) options() ([]Option, ConfigErrors) {
+	opts := []Option{
+		WithDialConfig(c.Dial.DialConfig()),
+		MaxIdle(c.MaxIdle),
+		MinIdle(c.MinIdle),
+		Lazy(c.Lazy),
+		MaxActive(c.MaxActive),
+		UnlimitedCap(c.UnlimitedCap),
+		MaxConcurrentStreams(c.MaxConcurrentStreams),
+		Reuse(c.Reuse),
+		DialConcurrency(c.DialConcurrency),
+		MinStart(c.MinStart),
+		FillBackoff(time.Duration(c.FillBackoff), time.Duration(c.FillMaxBackoff)),
+		AsyncGrowth(c.AsyncGrowth),
+		MaintainInterval(time.Duration(c.MaintainInterval)),
+		AdaptiveStreams(c.AdaptiveStreams),
+		MaxOneShot(c.MaxOneShot),
+		DialRate(c.DialRate, c.DialBurst),
+		CircuitBreaker(c.CircuitBreakerThreshold, time.Duration(c.CircuitBreakerTimeout)),
+		Strict(c.Strict),
+		Block(c.Block),
+		MaxWaiting(c.MaxWaiting),
+		Shards(c.Shards),
+	}
+	var errs ConfigErrors
+	if growth, err := c.growth(); err != nil {
+		errs = append(errs, err)
+	} else {
+		opts = append(opts, Growth(growth))
+	}
+	if shrink, err := c.shrink(); err != nil {
+		errs = append(errs, err)
+	} else {
+		opts = append(opts, Shrink(shrink))
+	}
+	if pick, err := c.pick(); err != nil {
+		errs = append(errs, err)
+	} else {
+		opts = append(opts, Pick(pick))
+	}
+	if order, err := c.waitOrder(); err != nil {
+		errs = append(errs, err)
+	} else {
+		opts = append(opts, WaitOrder(order))
+	}
+	if c.OutlierDetection != nil {
+		opts = append(opts, DetectOutliers(c.OutlierDetection.OutlierDetection()))
+	}
+	return opts, errs
+}
+
+// NewFromConfig creates a pool from the configuration, opts are applied after it,
+// e.g. PerRPCCredentials or RedialOn which can't be expressed in a file.
+func NewFromConfig(c Config, opts ...Option) (Pool, error) {
+	cfgOpts, err := c.Options()
+	if err != nil {
+		return nil, err
+	}
+	return New(c.Address, append(cfgOpts, opts...)...)
+}
+
+func (c Config) growth() (GrowthPolicy, error) {
+	switch c.GrowthPolicy {
+	case "double":
+		return DoubleGrowth(), nil
+	case "linear":
+		if c.GrowthStep > 0 {
+			return LinearGrowth(c.GrowthStep), nil
+		}
+	case "percent":
+		if c.GrowthStep > 0 {
+			return PercentGrowth(c.GrowthStep), nil
+		}
+	default:
+		return nil, &ConfigError{Field: "growthPolicy", Err: fmt.Errorf("unknown policy %q", c.GrowthPolicy)}
+	}
+	return nil, &ConfigError{Field: "growthStep", Err: fmt.Errorf("must be positive for %q", c.GrowthPolicy)}
+}
+
+func (c Config) shrink() (ShrinkPolicy, error) {
+	switch c.ShrinkPolicy {
+	case "maxIdle":
+		return ShrinkToMaxIdle(), nil
+	case "stepDown":
+		return StepDownShrink(c.ShrinkStep), nil
+	case "lru":
+		return LRUShrink(), nil
+	case "oldest":
+		return OldestShrink(), nil
+	}
+	return nil, &ConfigError{Field: "shrinkPolicy", Err: fmt.Errorf("unknown policy %q", c.ShrinkPolicy)}
+}
+
+func (c Config) pick() (PickPolicy, error) {
+	switch c.PickPolicy {
+	case "roundRobin":
+		return RoundRobinPick, nil
+	case "leastLoaded":
+		return LeastLoadedPick, nil
+	case "fastest":
+		return FastestPick, nil
+	}
+	return 0, &ConfigError{Field: "pickPolicy", Err: fmt.Errorf("unknown policy %q", c.PickPolicy)}
+}
+
+func (c Config) waitOrder() (QueueOrder, error) {
+	switch c.WaitOrder {
+	case "fifo":
+		return FIFOOrder, nil
+	case "lifo":
+		return LIFOOrder, nil
+	}
+	return 0, &ConfigError{Field: "waitOrder", Err: fmt.Errorf("unknown order %q", c.WaitOrder)}
+}
+
+// OutlierDetection converts the settings to an OutlierDetection.
+func (s OutlierSettings) OutlierDetection() OutlierDetection {
+	d := DefaultOutlierDetection()
+	if s.ErrorRate != 0 {
+		d.ErrorRate = s.ErrorRate
+	}
+	if s.MinRequests != 0 {
+		d.MinRequests = s.MinRequests
+	}
+	if s.BaseEjection != 0 {
+		d.BaseEjection = time.Duration(s.BaseEjection)
+	}
+	if s.MaxEjection != 0 {
+		d.MaxEjection = time.Duration(s.MaxEjection)
+	}
+	if s.MaxEjections != 0 {
+		d.MaxEjections = s.MaxEjections
+	}
+	if s.MaxEjectedPercent != 0 {
+		d.MaxEjectedPercent = s.MaxEjectedPercent
+	}
+	return d
+}
+
+// DialConfig converts the settings to a DialConfig.
+func (s DialSettings) DialConfig() DialConfig {
+	d := DialConfig{
+		Timeout:               time.Duration(s.Timeout),
+		BackoffMaxDelay:       time.Duration(s.BackoffMaxDelay),
+		Insecure:              s.Insecure,
+		KeepAliveTime:         time.Duration(s.KeepAliveTime),
+		KeepAliveTimeout:      time.Duration(s.KeepAliveTimeout),
+		PermitWithoutStream:   s.PermitWithoutStream,
+		InitialWindowSize:     s.InitialWindowSize,
+		InitialConnWindowSize: s.InitialConnWindowSize,
+		MaxSendMsgSize:        s.MaxSendMsgSize,
+		MaxRecvMsgSize:        s.MaxRecvMsgSize,
+		Compressor:            s.Compressor,
+		UserAgent:             s.UserAgent,
+	}
+	if s.TLS != nil {
+		tls := *s.TLS
+		d.TLS = &tls
+	}
+	return d
+}
+
+var textUnmarshalerType = reflect.TypeOf((*interface{ UnmarshalText([]byte) error })(nil)).Elem()
+
+// applyEnv overrides the fields of the struct v with the environment variables named
+// prefix followed by their json names in upper snake case, nested structs append their names.
+func applyEnv(v reflect.Value, prefix string) ConfigErrors {
+	var errs ConfigErrors
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field, value := t.Field(i), v.Field(i)
+		name := prefix + envName(strings.Split(field.Tag.Get("json"), ",")[0])
+
+		switch {
+		case field.Type.Kind() == reflect.Struct:
+			errs = append(errs, applyEnv(value, name+"_")...)
+			continue
+		case field.Type.Kind() == reflect.Ptr && field.Type.Elem().Kind() == reflect.Struct:
+			// 指针字段仅在有对应环境变量时才分配
+			elem := reflect.New(field.Type.Elem())
+			if !value.IsNil() {
+				elem.Elem().Set(value.Elem())
+			}
+			if hasEnv(name + "_") {
+				errs = append(errs, applyEnv(elem.Elem(), name+"_")...)
+				value.Set(elem)
+			}
+			continue
+		}
+
+		env, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := setValue(value, env); err != nil {
+			errs = append(errs, &ConfigError{Field: name, Err: err})
+		}
+	}
+	return errs
+}
+
+func setValue(v reflect.Value, s string) error {
+	if v.Addr().Type().Implements(textUnmarshalerType) {
+		return v.Addr().Interface().(interface{ UnmarshalText([]byte) error }).UnmarshalText([]byte(s))
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+func hasEnv(prefix string) bool {
+	for _, kv := range os.Environ() {
+		if strings.HasPrefix(kv, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// envName converts the camel case name to upper snake case, e.g. maxIdle to MAX_IDLE.
+func envName(name string) string {
+	var b strings.Builder
+	for i, r := range name {
+		if unicode.IsUpper(r) && i > 0 {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
@@ -0,0 +1,134 @@
+// Copyright 2023 chengyayu. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpcpool
+
+import (
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	yamlFile := writeFile(t, "pool.yaml", `
+address: 127.0.0.1:50051
+maxIdle: 4
+maxActive: 16
+reuse: false
+fillBackoff: 200ms
+growthPolicy: linear
+growthStep: 2
+dial:
+  timeout: 2s
+  insecure: false
+  tls:
+    caFile: ca.pem
+`)
+	jsonFile := writeFile(t, "pool.json", `{
+	"address": "127.0.0.1:50051",
+	"maxIdle": 4,
+	"maxActive": 16,
+	"reuse": false,
+	"fillBackoff": "200ms",
+	"growthPolicy": "linear",
+	"growthStep": 2,
+	"dial": {"timeout": "2s", "insecure": false, "tls": {"caFile": "ca.pem"}}
+}`)
+
+	for _, path := range []string{yamlFile, jsonFile} {
+		c, err := LoadConfig(path)
+		require.NoError(t, err, path)
+		require.Equal(t, "127.0.0.1:50051", c.Address)
+		require.Equal(t, 4, c.MaxIdle)
+		require.Equal(t, 16, c.MaxActive)
+		require.False(t, c.Reuse)
+		require.Equal(t, Duration(200*time.Millisecond), c.FillBackoff)
+		require.Equal(t, Duration(2*time.Second), c.Dial.Timeout)
+		require.Equal(t, "ca.pem", c.Dial.TLS.CAFile)
+		// the missing fields keep the defaults.
+		require.Equal(t, DftMaxConcurrentStreams, c.MaxConcurrentStreams)
+		require.Equal(t, Duration(KeepAliveTime), c.Dial.KeepAliveTime)
+	}
+
+	// the environment overrides the file.
+	t.Setenv("GRPCPOOL_MAX_IDLE", "2")
+	t.Setenv("GRPCPOOL_DIAL_TIMEOUT", "1s")
+	t.Setenv("GRPCPOOL_DIAL_TLS_SERVER_NAME", "example.com")
+	c, err := LoadConfig(yamlFile)
+	require.NoError(t, err)
+	require.Equal(t, 2, c.MaxIdle)
+	require.Equal(t, Duration(time.Second), c.Dial.Timeout)
+	require.Equal(t, "ca.pem", c.Dial.TLS.CAFile)
+	require.Equal(t, "example.com", c.Dial.TLS.ServerName)
+
+	_, err = LoadConfig(writeFile(t, "pool.toml", ""))
+	require.Error(t, err)
+}
+
+func TestConfigValidate(t *testing.T) {
+	t.Setenv("GRPCPOOL_ADDRESS", "127.0.0.1:50051")
+	t.Setenv("GRPCPOOL_MAX_IDLE", "many")
+	t.Setenv("GRPCPOOL_MAX_CONCURRENT_STREAMS", "0")
+	t.Setenv("GRPCPOOL_SHRINK_POLICY", "random")
+	t.Setenv("GRPCPOOL_DIAL_TIMEOUT", "0s")
+
+	_, err := LoadConfig("")
+	require.Error(t, err)
+	errs, ok := err.(ConfigErrors)
+	require.True(t, ok)
+	require.Len(t, errs, 4)
+	require.Contains(t, err.Error(), "GRPCPOOL_MAX_IDLE")
+	require.Contains(t, err.Error(), "maxConcurrentStreams")
+	require.Contains(t, err.Error(), "shrinkPolicy")
+	require.Contains(t, err.Error(), "dial timeout")
+
+	// the settings are checked by the same rules as New.
+	c := DefaultConfig()
+	c.Address = *endpoint
+	c.MaxIdle, c.MaxActive, c.MinIdle = 4, 2, 8
+	_, newErr := New(*endpoint, Dial(DialTest), MaxIdle(4), MaxActive(2), MinIdle(8))
+	require.Error(t, newErr)
+	require.EqualError(t, c.Validate(), newErr.Error())
+}
+
+func TestNewFromConfig(t *testing.T) {
+	c := DefaultConfig()
+	c.Address = *endpoint
+	c.MaxIdle, c.MaxActive = 2, 4
+	c.ShrinkPolicy = "lru"
+	p, err := NewFromConfig(c)
+	require.NoError(t, err)
+	defer p.Close()
+
+	stats := p.Stats()
+	require.Equal(t, 2, stats.Current)
+	require.Equal(t, 4, stats.MaxActive)
+
+	c.GrowthPolicy, c.GrowthStep = "percent", 0
+	_, err = NewFromConfig(c)
+	require.Error(t, err)
+
+	c.GrowthPolicy = "double"
+	c.Block, c.WaitOrder = true, "random"
+	_, err = NewFromConfig(c)
+	require.ErrorContains(t, err, "waitOrder")
+}
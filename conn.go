@@ -16,7 +16,12 @@
 
 package grpcpool
 
-import "google.golang.org/grpc"
+import (
+	"fmt"
+	"google.golang.org/grpc"
+	"sync/atomic"
+	"time"
+)
 
 // Conn single grpc connection interface
 type Conn interface {
@@ -30,9 +35,35 @@ type Conn interface {
 
 // Conn is wrapped grpc.ClientConn. to provide close and value method.
 type conn struct {
+	// atomic, unix nano of the last time the connection was released by all its borrowers.
+	// keep it first to be 64-bit aligned.
+	lastUsed int64
+
+	// atomic, unix nano until which the connection is ejected from the selection as an outlier.
+	ejectedUntil int64
+
 	cc   *grpc.ClientConn
 	pool *pool
 	once bool
+
+	// atomic, the borrowed references of this physical connection.
+	ref int32
+
+	// atomic, set when the connection is replaced by pool.Redial.
+	// a retired connection is closed after its last reference is released.
+	retired int32
+
+	// atomic, guarantee the retired connection is closed only once.
+	released int32
+
+	// when the connection was dialed.
+	createdAt time.Time
+
+	// ejections is the number of consecutive ejections, guarded by the pool lock.
+	ejections int
+
+	// tracker observes the RPCs of the connection, nil if the dial function is supplied by the application.
+	tracker *tracker
 }
 
 // Value see Conn interface.
@@ -42,10 +73,55 @@ func (c *conn) Value() *grpc.ClientConn {
 
 // Close see Conn interface.
 func (c *conn) Close() error {
-	c.pool.decrRef()
 	if c.once {
+		c.pool.decrRef()
+		c.pool.releaseOneShot()
 		return c.reset()
 	}
+	ref := atomic.AddInt32(&c.ref, -1)
+	if ref < 0 {
+		// 重复归还：恢复引用计数并报告错误，连接池的引用计数不变。
+		atomic.AddInt32(&c.ref, 1)
+		c.pool.report(fmt.Errorf("%w: ref %d", ErrNegativeRef, ref))
+		return nil
+	}
+	if ref == 0 {
+		// 只在最后一个借用者归还时记录，借出的热路径不读时钟
+		atomic.StoreInt64(&c.lastUsed, time.Now().UnixNano())
+	}
+	c.pool.releaseRef(c)
+	return c.releaseRetired(ref)
+}
+
+// 物理连接引用计数减一，已退役的连接在最后一个引用释放后关闭。
+func (c *conn) unref() error {
+	return c.releaseRetired(atomic.AddInt32(&c.ref, -1))
+}
+
+// releaseRetired closes the retired connection if ref, the references left by a release, is zero.
+func (c *conn) releaseRetired(ref int32) error {
+	if ref != 0 || atomic.LoadInt32(&c.retired) == 0 {
+		return nil
+	}
+	// 释放后、退役前可能被旧快照中的 Get 再次借出，重新读取引用计数，由新的借用者归还时关闭。
+	if atomic.LoadInt32(&c.ref) != 0 {
+		return nil
+	}
+	return c.release()
+}
+
+// 将连接标记为退役，没有引用时立即关闭。
+func (c *conn) retire() {
+	atomic.StoreInt32(&c.retired, 1)
+	if atomic.LoadInt32(&c.ref) == 0 {
+		_ = c.release()
+	}
+}
+
+func (c *conn) release() error {
+	if atomic.CompareAndSwapInt32(&c.released, 0, 1) {
+		return c.cc.Close()
+	}
 	return nil
 }
 
@@ -59,3 +135,63 @@ func (c *conn) reset() error {
 	}
 	return nil
 }
+
+// streams returns the logic connections the physical connection serves.
+func (c *conn) streams(o *options) int {
+	if c.tracker == nil || o.adaptiveStreams == 0 {
+		return o.maxConcurrentStreams
+	}
+	return c.tracker.effective(o.maxConcurrentStreams)
+}
+
+// load returns the larger of the borrowed references and the in-flight RPCs.
+func (c *conn) load() int32 {
+	load := atomic.LoadInt32(&c.ref)
+	if c.tracker != nil {
+		if inflight := atomic.LoadInt32(&c.tracker.inflight); inflight > load {
+			load = inflight
+		}
+	}
+	return load
+}
+
+// busy reports whether the connection has in-flight RPCs.
+func (c *conn) busy() bool {
+	return c != nil && c.tracker != nil && atomic.LoadInt32(&c.tracker.inflight) > 0
+}
+
+// ejected reports whether the connection is ejected from the selection at now.
+func (c *conn) ejected(now int64) bool {
+	return c != nil && atomic.LoadInt64(&c.ejectedUntil) > now
+}
+
+// latency returns the moving average of the RPC latency, zero if unknown.
+func (c *conn) latency() time.Duration {
+	if c.tracker == nil {
+		return 0
+	}
+	return time.Duration(atomic.LoadInt64(&c.tracker.latency))
+}
+
+func (c *conn) stat(index int, o *options) ConnStat {
+	s := ConnStat{
+		Index:     index,
+		CreatedAt: c.createdAt,
+		Ref:       int(atomic.LoadInt32(&c.ref)),
+		Streams:   c.streams(o),
+		Latency:   c.latency(),
+		Ejected:   c.ejected(o.now()),
+	}
+	if lastUsed := atomic.LoadInt64(&c.lastUsed); lastUsed > 0 {
+		s.LastUsed = time.Unix(0, lastUsed)
+	}
+	if t := c.tracker; t != nil {
+		s.InFlight = int(atomic.LoadInt32(&t.inflight))
+		s.BytesSent = atomic.LoadInt64(&t.bytesSent)
+		s.BytesReceived = atomic.LoadInt64(&t.bytesReceived)
+		if lastActive := atomic.LoadInt64(&t.lastActive); lastActive > 0 {
+			s.LastActive = time.Unix(0, lastActive)
+		}
+	}
+	return s
+}
@@ -0,0 +1,147 @@
+// Copyright 2023 chengyayu. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpcpool
+
+import (
+	"math"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// cacheLine is the size the hot counters are padded to, so the cores updating one counter
+// don't invalidate the cache line of another (false sharing).
+const cacheLine = 64
+
+// paddedInt32 is an atomic int32 alone in its cache line.
+type paddedInt32 struct {
+	v int32
+	_ [cacheLine - 4]byte
+}
+
+func (c *paddedInt32) add(delta int32) int32 {
+	return atomic.AddInt32(&c.v, delta)
+}
+
+func (c *paddedInt32) load() int32 {
+	return atomic.LoadInt32(&c.v)
+}
+
+func (c *paddedInt32) store(v int32) {
+	atomic.StoreInt32(&c.v, v)
+}
+
+// paddedInt64 is an atomic int64 alone in its cache line.
+type paddedInt64 struct {
+	v int64
+	_ [cacheLine - 8]byte
+}
+
+func (c *paddedInt64) add(delta int64) int64 {
+	return atomic.AddInt64(&c.v, delta)
+}
+
+func (c *paddedInt64) load() int64 {
+	return atomic.LoadInt64(&c.v)
+}
+
+func (c *paddedInt64) store(v int64) {
+	atomic.StoreInt64(&c.v, v)
+}
+
+// stripedCounter is a counter split into padded stripes, one per P in general, so the
+// concurrent updates on different Ps don't contend. Its value is the sum of the stripes.
+// A stripe drifts when the increments and decrements run on different Ps, it may be negative
+// or large while the sum is small, so the limits are checked against the sum.
+type stripedCounter struct {
+	stripes []paddedInt64
+	mask    uint32
+
+	// atomic, set once a stripe reaches the limit of incr divided by the stripes,
+	// the sum is checked by incr from then on.
+	hot int32
+}
+
+// newStripedCounter returns a counter with a stripe per P, rounded up to a power of two.
+func newStripedCounter() stripedCounter {
+	n := 1
+	for n < runtime.GOMAXPROCS(0) {
+		n *= 2
+	}
+	return stripedCounter{stripes: make([]paddedInt64, n), mask: uint32(n - 1)}
+}
+
+// add adds delta to the stripe of hint, see procHint.
+func (c *stripedCounter) add(hint uint32, delta int32) {
+	c.stripes[hint&c.mask].add(int64(delta))
+}
+
+// incr adds one to the stripe of hint unless the sum reaches max, it reports whether it did.
+// While every stripe is below max divided by the stripes the sum can't reach max,
+// so the stripes are summed only after one of them reached it.
+func (c *stripedCounter) incr(hint uint32, max int64) bool {
+	s := &c.stripes[hint&c.mask]
+	if s.add(1) >= max/int64(len(c.stripes)) && atomic.LoadInt32(&c.hot) == 0 {
+		atomic.StoreInt32(&c.hot, 1)
+	}
+	if atomic.LoadInt32(&c.hot) == 0 || c.sum() < max {
+		return true
+	}
+	s.add(-1)
+	return false
+}
+
+// sum returns the sum of the stripes, it's not a snapshot of the concurrent updates.
+func (c *stripedCounter) sum() int64 {
+	var sum int64
+	for i := range c.stripes {
+		sum += c.stripes[i].load()
+	}
+	return sum
+}
+
+// load returns the sum of the stripes capped at math.MaxInt32.
+func (c *stripedCounter) load() int32 {
+	if sum := c.sum(); sum < math.MaxInt32 {
+		return int32(sum)
+	}
+	return math.MaxInt32
+}
+
+// reset sets the counter to zero.
+func (c *stripedCounter) reset() {
+	for i := range c.stripes {
+		c.stripes[i].store(0)
+	}
+	atomic.StoreInt32(&c.hot, 0)
+}
+
+var (
+	// hints hands out the hints, sync.Pool keeps a hint per P, so the goroutines running
+	// on the same P get the same hint in general.
+	hints = sync.Pool{New: func() interface{} {
+		h := atomic.AddUint32(&nextHint, 1)
+		return &h
+	}}
+	nextHint uint32
+)
+
+// procHint returns a cheap hint of the P the goroutine is running on, without allocation.
+func procHint() uint32 {
+	h := hints.Get().(*uint32)
+	hint := *h
+	hints.Put(h)
+	return hint
+}
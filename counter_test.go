@@ -0,0 +1,50 @@
+// Copyright 2023 chengyayu. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpcpool
+
+import (
+	"github.com/stretchr/testify/require"
+	"math"
+	"testing"
+)
+
+func TestStripedCounter(t *testing.T) {
+	c := stripedCounter{stripes: make([]paddedInt64, 4), mask: 3}
+
+	// the sum reaching the limit is rejected, wherever the increments are.
+	for i := 0; i < 7; i++ {
+		require.True(t, c.incr(uint32(i), 8))
+	}
+	require.False(t, c.incr(3, 8))
+	require.EqualValues(t, 7, c.sum())
+	c.reset()
+
+	// a stripe drifting beyond the limit is not an overflow while the sum is small,
+	// e.g. the increments on a P and the decrements on another.
+	for i := 0; i < 10; i++ {
+		require.True(t, c.incr(0, 8))
+		c.add(1, -1)
+	}
+	require.True(t, c.incr(0, 8))
+	require.EqualValues(t, 1, c.sum())
+	c.reset()
+
+	// the sum doesn't wrap around.
+	for i := range c.stripes {
+		c.stripes[i].store(math.MaxInt32)
+	}
+	require.EqualValues(t, 4*math.MaxInt32, c.sum())
+	require.EqualValues(t, math.MaxInt32, c.load())
+}
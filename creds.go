@@ -0,0 +1,87 @@
+// Copyright 2023 chengyayu. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpcpool
+
+import (
+	"context"
+	"google.golang.org/grpc/credentials"
+	"sync/atomic"
+)
+
+// TokenCredentials attaches a static bearer token to every RPC.
+// For a refreshing token source, see google.golang.org/grpc/credentials/oauth.
+type TokenCredentials struct {
+	// Token is sent as "authorization: Bearer <Token>".
+	Token string
+
+	// AllowInsecure permits sending the token over connections without transport security.
+	AllowInsecure bool
+}
+
+// GetRequestMetadata see credentials.PerRPCCredentials interface.
+func (t TokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + t.Token}, nil
+}
+
+// RequireTransportSecurity see credentials.PerRPCCredentials interface.
+func (t TokenCredentials) RequireTransportSecurity() bool {
+	return !t.AllowInsecure
+}
+
+// RotatingCredentials delegates to per-RPC credentials which can be rotated at runtime.
+// Pass it to the PerRPCCredentials option, the pool then re-dials its connections
+// when a rotation requires connection-level re-authentication.
+type RotatingCredentials struct {
+	notifier
+
+	current atomic.Value // perRPCHolder
+}
+
+// perRPCHolder makes credentials of different types storable in the same atomic.Value.
+type perRPCHolder struct {
+	creds credentials.PerRPCCredentials
+}
+
+// NewRotatingCredentials returns RotatingCredentials starting with src.
+func NewRotatingCredentials(src credentials.PerRPCCredentials) *RotatingCredentials {
+	r := &RotatingCredentials{}
+	r.current.Store(perRPCHolder{creds: src})
+	return r
+}
+
+// Rotate replaces the credentials used by subsequent RPCs. When reconnect is true,
+// subscribers are notified so the connections authenticated with the old credentials are re-dialed.
+// The pools re-dial in the background, Rotate doesn't wait for the dials, their errors are
+// reported to OnError of each pool.
+func (r *RotatingCredentials) Rotate(src credentials.PerRPCCredentials, reconnect bool) {
+	r.current.Store(perRPCHolder{creds: src})
+	if reconnect {
+		r.notify()
+	}
+}
+
+func (r *RotatingCredentials) creds() credentials.PerRPCCredentials {
+	return r.current.Load().(perRPCHolder).creds
+}
+
+// GetRequestMetadata see credentials.PerRPCCredentials interface.
+func (r *RotatingCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return r.creds().GetRequestMetadata(ctx, uri...)
+}
+
+// RequireTransportSecurity see credentials.PerRPCCredentials interface.
+func (r *RotatingCredentials) RequireTransportSecurity() bool {
+	return r.creds().RequireTransportSecurity()
+}
@@ -0,0 +1,243 @@
+// Copyright 2023 chengyayu. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpcpool
+
+import (
+	"context"
+	"fmt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/keepalive"
+	"net"
+	"path/filepath"
+	"time"
+)
+
+// minWindowSize is the smallest window size grpc accepts, smaller values are ignored silently.
+const minWindowSize = 64 * 1024
+
+// DialConfig describes how a grpc connection is created.
+// Start from DefaultDialConfig and override the fields you need, then call Build
+// to get a dial function for the Dial option.
+type DialConfig struct {
+	// Timeout bounds a single dial attempt.
+	Timeout time.Duration
+
+	// BackoffMaxDelay provided maximum delay when backing off after failed connection attempts.
+	BackoffMaxDelay time.Duration
+
+	// Credentials are the transport credentials of the connection, e.g. CertWatcher.Credentials().
+	// Exactly one of Credentials, TLS and Insecure must be set.
+	Credentials credentials.TransportCredentials
+
+	// TLS loads TLS or mTLS credentials from files once when Build is called.
+	TLS *TLSConfig
+
+	// Insecure dials without transport security.
+	Insecure bool
+
+	// PerRPCCredentials are attached to every RPC, e.g. TokenCredentials or RotatingCredentials.
+	// Like the PerRPCCredentials option, the pool re-dials when RotatingCredentials asks to.
+	PerRPCCredentials credentials.PerRPCCredentials
+
+	// KeepAliveTime pings the server after such a duration of inactivity, zero disables keepalive.
+	KeepAliveTime time.Duration
+
+	// KeepAliveTimeout closes the connection if the ping is not answered in such a duration.
+	KeepAliveTimeout time.Duration
+
+	// PermitWithoutStream sends keepalive pings even without active streams.
+	PermitWithoutStream bool
+
+	// InitialWindowSize is the stream level window size, zero keeps the grpc default.
+	InitialWindowSize int32
+
+	// InitialConnWindowSize is the connection level window size, zero keeps the grpc default.
+	InitialConnWindowSize int32
+
+	// MaxSendMsgSize is the max request message size, zero keeps the grpc default.
+	MaxSendMsgSize int
+
+	// MaxRecvMsgSize is the max response message size, zero keeps the grpc default.
+	MaxRecvMsgSize int
+
+	// Compressor is the name of a registered compressor used for every call, e.g. "gzip".
+	Compressor string
+
+	// UserAgent is prepended to the grpc user agent.
+	UserAgent string
+
+	// ContextDialer creates the underlying net.Conn instead of the default tcp or unix dialer,
+	// e.g. for a custom transport. It receives the resolved address, for unix targets the socket path.
+	ContextDialer func(ctx context.Context, addr string) (net.Conn, error)
+
+	// DialOptions are appended after the options generated from the fields above.
+	DialOptions []grpc.DialOption
+}
+
+// DefaultDialConfig returns the configuration DftDial uses.
+func DefaultDialConfig() DialConfig {
+	return DialConfig{
+		Timeout:               DialTimeout,
+		BackoffMaxDelay:       BackoffMaxDelay,
+		Insecure:              true,
+		KeepAliveTime:         KeepAliveTime,
+		KeepAliveTimeout:      KeepAliveTimeout,
+		PermitWithoutStream:   true,
+		InitialWindowSize:     InitialWindowSize,
+		InitialConnWindowSize: InitialConnWindowSize,
+		MaxSendMsgSize:        MaxSendMsgSize,
+		MaxRecvMsgSize:        MaxRecvMsgSize,
+	}
+}
+
+// Validate reports invalid or conflicting settings.
+func (c DialConfig) Validate() error {
+	if c.Timeout <= 0 {
+		return configError("dial timeout", "")
+	}
+	if c.BackoffMaxDelay < 0 || c.KeepAliveTime < 0 || c.KeepAliveTimeout < 0 {
+		return configError("negative duration", "")
+	}
+	switch n := countTrue(c.Credentials != nil, c.TLS != nil, c.Insecure); {
+	case n > 1:
+		return configError("credentials", "only one of credentials, tls and insecure can be set")
+	case n == 0:
+		return configError("credentials", "one of credentials, tls and insecure must be set")
+	}
+	if c.TLS != nil {
+		if err := c.TLS.Validate(); err != nil {
+			return err
+		}
+	}
+	if c.PerRPCCredentials != nil && c.PerRPCCredentials.RequireTransportSecurity() && c.Insecure {
+		return configError("per rpc credentials", "transport security is required")
+	}
+	if c.KeepAliveTime == 0 && (c.KeepAliveTimeout > 0 || c.PermitWithoutStream) {
+		return configError("keepalive", "keepalive time is required")
+	}
+	if (c.InitialWindowSize != 0 && c.InitialWindowSize < minWindowSize) ||
+		(c.InitialConnWindowSize != 0 && c.InitialConnWindowSize < minWindowSize) {
+		return &ConfigError{Field: "window size", Err: fmt.Errorf("must be zero or at least %d", minWindowSize)}
+	}
+	if c.MaxSendMsgSize < 0 || c.MaxRecvMsgSize < 0 {
+		return configError("message size", "")
+	}
+	if c.Compressor != "" && encoding.GetCompressor(c.Compressor) == nil {
+		return &ConfigError{Field: "compressor", Err: fmt.Errorf("%q is not registered", c.Compressor)}
+	}
+	return nil
+}
+
+// Build validates the configuration and returns a dial function for the Dial option.
+func (c DialConfig) Build() (func(address string) (*grpc.ClientConn, error), error) {
+	dial, err := c.build()
+	if err != nil {
+		return nil, err
+	}
+	return func(address string) (*grpc.ClientConn, error) { return dial(address) }, nil
+}
+
+// build is Build with extra options the pool appends to every dial,
+// the returned function accepts the options of a single dial as well.
+func (c DialConfig) build(extra ...grpc.DialOption) (func(address string, opts ...grpc.DialOption) (*grpc.ClientConn, error), error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	if c.TLS != nil {
+		creds, err := c.TLS.Credentials()
+		if err != nil {
+			return nil, err
+		}
+		c.Credentials, c.TLS = creds, nil
+	}
+	c.DialOptions = append(append([]grpc.DialOption(nil), c.DialOptions...), extra...)
+	return c.dial, nil
+}
+
+func (c DialConfig) dial(address string, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	defer cancel()
+	return grpc.DialContext(ctx, address, append(c.dialOptions(), opts...)...)
+}
+
+func (c DialConfig) dialOptions() []grpc.DialOption {
+	creds := c.Credentials
+	if c.Insecure {
+		creds = insecure.NewCredentials()
+	}
+	opts := []grpc.DialOption{grpc.WithTransportCredentials(creds)}
+	if c.BackoffMaxDelay > 0 {
+		opts = append(opts, grpc.WithBackoffMaxDelay(c.BackoffMaxDelay))
+	}
+	if c.InitialWindowSize > 0 {
+		opts = append(opts, grpc.WithInitialWindowSize(c.InitialWindowSize))
+	}
+	if c.InitialConnWindowSize > 0 {
+		opts = append(opts, grpc.WithInitialConnWindowSize(c.InitialConnWindowSize))
+	}
+
+	var callOpts []grpc.CallOption
+	if c.MaxSendMsgSize > 0 {
+		callOpts = append(callOpts, grpc.MaxCallSendMsgSize(c.MaxSendMsgSize))
+	}
+	if c.MaxRecvMsgSize > 0 {
+		callOpts = append(callOpts, grpc.MaxCallRecvMsgSize(c.MaxRecvMsgSize))
+	}
+	if c.Compressor != "" {
+		callOpts = append(callOpts, grpc.UseCompressor(c.Compressor))
+	}
+	if len(callOpts) > 0 {
+		opts = append(opts, grpc.WithDefaultCallOptions(callOpts...))
+	}
+
+	if c.KeepAliveTime > 0 {
+		opts = append(opts, grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                c.KeepAliveTime,
+			Timeout:             c.KeepAliveTimeout,
+			PermitWithoutStream: c.PermitWithoutStream,
+		}))
+	}
+	if c.PerRPCCredentials != nil {
+		opts = append(opts, grpc.WithPerRPCCredentials(c.PerRPCCredentials))
+	}
+	if c.UserAgent != "" {
+		opts = append(opts, grpc.WithUserAgent(c.UserAgent))
+	}
+	if c.ContextDialer != nil {
+		opts = append(opts, grpc.WithContextDialer(c.ContextDialer))
+	}
+	return append(opts, c.DialOptions...)
+}
+
+func countTrue(bs ...bool) int {
+	n := 0
+	for _, b := range bs {
+		if b {
+			n++
+		}
+	}
+	return n
+}
+
+// UnixTarget returns the grpc target of the unix domain socket at path.
+func UnixTarget(path string) string {
+	if filepath.IsAbs(path) {
+		return "unix://" + path
+	}
+	return "unix:" + path
+}
@@ -0,0 +1,196 @@
+// Copyright 2023 chengyayu. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpcpool
+
+import (
+	"context"
+	"github.com/chengyayu/grpcpool/example/single/pb"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	_ "google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/test/bufconn"
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type echoServer struct {
+	pb.UnimplementedEchoServer
+}
+
+func (s *echoServer) Say(ctx context.Context, req *pb.EchoRequest) (*pb.EchoResponse, error) {
+	return &pb.EchoResponse{Message: req.GetMessage()}, nil
+}
+
+// startEchoServer serves the echo service on lis until the test finishes.
+func startEchoServer(t *testing.T, lis net.Listener, opts ...grpc.ServerOption) {
+	s := grpc.NewServer(opts...)
+	pb.RegisterEchoServer(s, &echoServer{})
+	go func() { _ = s.Serve(lis) }()
+	t.Cleanup(s.Stop)
+}
+
+// say sends a echo request with conn and waits for the response.
+func say(conn Conn) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := pb.NewEchoClient(conn.Value()).Say(ctx, &pb.EchoRequest{Message: []byte("hi")}, grpc.WaitForReady(true))
+	return err
+}
+
+func TestDialConfigValidate(t *testing.T) {
+	require.NoError(t, DefaultDialConfig().Validate())
+
+	cases := map[string]func(c *DialConfig){
+		"zero timeout":           func(c *DialConfig) { c.Timeout = 0 },
+		"negative backoff":       func(c *DialConfig) { c.BackoffMaxDelay = -time.Second },
+		"credentials+insecure":   func(c *DialConfig) { c.Credentials = insecure.NewCredentials() },
+		"no credentials":         func(c *DialConfig) { c.Insecure = false },
+		"keepalive without time": func(c *DialConfig) { c.KeepAliveTime = 0 },
+		"small window":           func(c *DialConfig) { c.InitialWindowSize = 1024 },
+		"negative message size":  func(c *DialConfig) { c.MaxRecvMsgSize = -1 },
+		"unknown compressor":     func(c *DialConfig) { c.Compressor = "unknown" },
+	}
+	for name, modify := range cases {
+		c := DefaultDialConfig()
+		modify(&c)
+		require.Error(t, c.Validate(), name)
+	}
+
+	c := DefaultDialConfig()
+	c.Compressor = "gzip"
+	c.UserAgent = "grpcpool-test"
+	c.KeepAliveTime, c.KeepAliveTimeout, c.PermitWithoutStream = 0, 0, false
+	require.NoError(t, c.Validate())
+}
+
+func TestDialConfigBuild(t *testing.T) {
+	c := DefaultDialConfig()
+	c.Timeout = 0
+	_, err := c.Build()
+	require.Error(t, err)
+
+	dial, err := DefaultDialConfig().Build()
+	require.NoError(t, err)
+
+	p, err := New(*endpoint, Dial(dial))
+	require.NoError(t, err)
+	defer p.Close()
+
+	conn, err := p.Get()
+	require.NoError(t, err)
+	require.EqualValues(t, true, conn.Value() != nil)
+	conn.Close()
+}
+
+func TestPerRPCCredentials(t *testing.T) {
+	var tokens []string
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	startEchoServer(t, lis, grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		tokens = append(tokens, md.Get("authorization")...)
+		return handler(ctx, req)
+	}))
+
+	_, err = New(lis.Addr().String(), PerRPCCredentials(TokenCredentials{Token: "a"}))
+	require.Error(t, err)
+	_, err = New(lis.Addr().String(), Dial(DialTest), PerRPCCredentials(TokenCredentials{Token: "a", AllowInsecure: true}))
+	require.Error(t, err)
+
+	creds := NewRotatingCredentials(TokenCredentials{Token: "a", AllowInsecure: true})
+	p, err := New(lis.Addr().String(), MaxIdle(1), PerRPCCredentials(creds))
+	require.NoError(t, err)
+	defer p.Close()
+	nativePool := p.(*pool)
+
+	conn, err := p.Get()
+	require.NoError(t, err)
+	require.NoError(t, say(conn))
+	conn.Close()
+
+	old := nativePool.snapshot()[0]
+	creds.Rotate(TokenCredentials{Token: "b", AllowInsecure: true}, false)
+	conn, err = p.Get()
+	require.NoError(t, err)
+	require.NoError(t, say(conn))
+	conn.Close()
+	require.True(t, nativePool.snapshot()[0] == old)
+
+	creds.Rotate(TokenCredentials{Token: "c", AllowInsecure: true}, true)
+	require.Eventually(t, func() bool { return nativePool.snapshot()[0] != old }, time.Second, time.Millisecond)
+	conn, err = p.Get()
+	require.NoError(t, err)
+	require.NoError(t, say(conn))
+	conn.Close()
+
+	require.Equal(t, []string{"Bearer a", "Bearer b", "Bearer c"}, tokens)
+
+	// the credentials in the DialConfig re-dial the pool as well.
+	c := DefaultDialConfig()
+	c.PerRPCCredentials = creds
+	p2, err := New(lis.Addr().String(), MaxIdle(1), WithDialConfig(c))
+	require.NoError(t, err)
+	defer p2.Close()
+	old = p2.(*pool).snapshot()[0]
+	creds.Rotate(TokenCredentials{Token: "d", AllowInsecure: true}, true)
+	require.Eventually(t, func() bool { return p2.(*pool).snapshot()[0] != old }, time.Second, time.Millisecond)
+}
+
+func TestUnixTarget(t *testing.T) {
+	require.Equal(t, "unix:///tmp/grpc.sock", UnixTarget("/tmp/grpc.sock"))
+	require.Equal(t, "unix:grpc.sock", UnixTarget("grpc.sock"))
+
+	path := filepath.Join(t.TempDir(), "grpc.sock")
+	lis, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	startEchoServer(t, lis)
+
+	p, err := New(UnixTarget(path), MaxIdle(2))
+	require.NoError(t, err)
+	defer p.Close()
+
+	conn, err := p.Get()
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, say(conn))
+}
+
+func TestContextDialer(t *testing.T) {
+	lis := bufconn.Listen(1024 * 1024)
+	startEchoServer(t, lis)
+
+	var dialed int32
+	c := DefaultDialConfig()
+	c.ContextDialer = func(ctx context.Context, addr string) (net.Conn, error) {
+		atomic.AddInt32(&dialed, 1)
+		require.Equal(t, "bufnet", addr)
+		return lis.DialContext(ctx)
+	}
+
+	p, err := New("passthrough:///bufnet", WithDialConfig(c), MaxIdle(1))
+	require.NoError(t, err)
+	defer p.Close()
+
+	conn, err := p.Get()
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, say(conn))
+	require.EqualValues(t, 1, atomic.LoadInt32(&dialed))
+}
@@ -0,0 +1,152 @@
+// Copyright 2023 chengyayu. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpcpool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The errors of the pool can be tested by errors.Is and errors.As, and they
+// implement GRPCStatus, so status.FromError and status.Code map them, and the
+// errors wrapping them, to the gRPC status codes:
+//
+//	ErrClosed, ErrCircuitOpen, *DialError    codes.Unavailable
+//	ErrPoolExhausted, ErrDialRateLimited     codes.ResourceExhausted
+//	ErrGetTimeout                            codes.DeadlineExceeded
+//	*ConfigError, ConfigErrors               codes.InvalidArgument
+//	ErrRefOverflow, ErrNegativeRef           codes.Internal
+var (
+	// ErrClosed is the error resulting if the pool is closed via pool.Close().
+	ErrClosed = newError(codes.Unavailable, "pool is closed", nil)
+
+	// ErrPoolExhausted is the error resulting if no connection is available and
+	// the pool is not able to grow.
+	ErrPoolExhausted = newError(codes.ResourceExhausted, "pool is exhausted", nil)
+
+	// ErrGetTimeout is the error resulting if the deadline of GetContext expires
+	// before a connection is available. It is also context.DeadlineExceeded.
+	ErrGetTimeout = newError(codes.DeadlineExceeded, "get connection timeout", context.DeadlineExceeded)
+
+	// ErrCircuitOpen is the error resulting if the pool doesn't dial because the
+	// recent dials failed, see CircuitBreaker.
+	ErrCircuitOpen = newError(codes.Unavailable, "dial circuit is open", nil)
+
+	// ErrDialRateLimited is the error resulting if the pool can't grow because
+	// the dials exceed the rate of DialRate. It is also ErrPoolExhausted.
+	ErrDialRateLimited = newError(codes.ResourceExhausted, "dial rate limited", ErrPoolExhausted)
+
+	// ErrRefOverflow is reported to OnError if the borrowed connections overflow the reference count.
+	ErrRefOverflow = newError(codes.Internal, "reference count overflow", nil)
+
+	// ErrNegativeRef is reported to OnError if the reference count becomes negative,
+	// i.e. a connection is closed more than once.
+	ErrNegativeRef = newError(codes.Internal, "negative reference count", nil)
+)
+
+// poolError is a sentinel error with its gRPC status code.
+type poolError struct {
+	msg  string
+	code codes.Code
+	// err is the more general error it is, if any.
+	err error
+}
+
+func newError(code codes.Code, msg string, err error) error {
+	return &poolError{msg: msg, code: code, err: err}
+}
+
+func (e *poolError) Error() string {
+	return e.msg
+}
+
+func (e *poolError) Unwrap() error {
+	return e.err
+}
+
+// GRPCStatus see status.FromError.
+func (e *poolError) GRPCStatus() *status.Status {
+	return status.New(e.code, e.msg)
+}
+
+// DialError is the error resulting if the pool fails to dial a physical connection.
+type DialError struct {
+	// Address is the server address dialed.
+	Address string
+
+	// Attempt is the number of consecutive failed dials of the pool, including this one.
+	Attempt int
+
+	// Err is the cause returned by the dial function.
+	Err error
+}
+
+func (e *DialError) Error() string {
+	return fmt.Sprintf("dial %s (attempt %d): %v", e.Address, e.Attempt, e.Err)
+}
+
+func (e *DialError) Unwrap() error {
+	return e.Err
+}
+
+// GRPCStatus see status.FromError.
+func (e *DialError) GRPCStatus() *status.Status {
+	return status.New(codes.Unavailable, e.Error())
+}
+
+// ConfigError is the error resulting if a setting is invalid or conflicts with another.
+type ConfigError struct {
+	// Field names the setting, e.g. "maxIdle" or "dial timeout".
+	Field string
+
+	// Err is the reason, nil if there is no more detail.
+	Err error
+}
+
+// configError returns a ConfigError of field, reason is optional.
+func configError(field, reason string) error {
+	e := &ConfigError{Field: field}
+	if reason != "" {
+		e.Err = errors.New(reason)
+	}
+	return e
+}
+
+func (e *ConfigError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("invalid %s settings", e.Field)
+	}
+	return fmt.Sprintf("invalid %s settings: %v", e.Field, e.Err)
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// GRPCStatus see status.FromError.
+func (e *ConfigError) GRPCStatus() *status.Status {
+	return status.New(codes.InvalidArgument, e.Error())
+}
+
+// getError returns the error of GetContext when ctx is done, ErrGetTimeout if its deadline expired.
+func getError(ctx context.Context) error {
+	if err := ctx.Err(); !errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	return ErrGetTimeout
+}
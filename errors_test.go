@@ -0,0 +1,133 @@
+// Copyright 2023 chengyayu. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpcpool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+	"time"
+)
+
+func TestErrorCodes(t *testing.T) {
+	for _, c := range []struct {
+		err  error
+		code codes.Code
+	}{
+		{ErrClosed, codes.Unavailable},
+		{ErrCircuitOpen, codes.Unavailable},
+		{ErrPoolExhausted, codes.ResourceExhausted},
+		{ErrDialRateLimited, codes.ResourceExhausted},
+		{ErrGetTimeout, codes.DeadlineExceeded},
+		{&DialError{Address: "a", Attempt: 1, Err: errors.New("refused")}, codes.Unavailable},
+		{&ConfigError{Field: "maxIdle"}, codes.InvalidArgument},
+		{ConfigErrors{&ConfigError{Field: "maxIdle"}}, codes.InvalidArgument},
+	} {
+		err, code := c.err, c.code
+		require.Equal(t, code, status.Code(err), err.Error())
+		// the wrapped errors keep the code
+		require.Equal(t, code, status.Code(fmt.Errorf("call: %w", err)), err.Error())
+	}
+
+	require.ErrorIs(t, ErrDialRateLimited, ErrPoolExhausted)
+	require.ErrorIs(t, ErrGetTimeout, context.DeadlineExceeded)
+	require.NotErrorIs(t, ErrPoolExhausted, ErrDialRateLimited)
+}
+
+func TestDialError(t *testing.T) {
+	refused := errors.New("connection refused")
+	dial := Dial(func(address string) (*grpc.ClientConn, error) { return nil, refused })
+
+	_, err := New(*endpoint, dial, MaxIdle(2), DialConcurrency(1))
+	require.ErrorIs(t, err, refused)
+	var dialErr *DialError
+	require.ErrorAs(t, err, &dialErr)
+	require.Equal(t, *endpoint, dialErr.Address)
+	require.Equal(t, 1, dialErr.Attempt)
+	require.Equal(t, codes.Unavailable, status.Code(err))
+
+	// the attempts count the consecutive failures of the pool.
+	p, err := New(*endpoint, dial, MaxIdle(1), Lazy(true))
+	require.NoError(t, err)
+	defer p.Close()
+	for i := 1; i <= 3; i++ {
+		_, err = p.Get()
+		require.ErrorAs(t, err, &dialErr)
+		require.Equal(t, i, dialErr.Attempt)
+	}
+	require.Zero(t, p.Stats().Ref)
+}
+
+func TestConfigError(t *testing.T) {
+	_, err := New(*endpoint, Dial(DialTest), MaxIdle(0))
+	var configErr *ConfigError
+	require.ErrorAs(t, err, &configErr)
+	require.Equal(t, "maximum", configErr.Field)
+	require.EqualError(t, err, "invalid maximum settings")
+
+	_, err = New("", Dial(DialTest))
+	require.ErrorAs(t, err, &configErr)
+	require.Equal(t, "address", configErr.Field)
+
+	c := DefaultConfig()
+	c.Address = *endpoint
+	c.MaxConcurrentStreams = 0
+	c.Dial.Timeout = 0
+	err = c.Validate()
+	require.ErrorAs(t, err, &configErr)
+	require.Equal(t, "maxConcurrentStreams", configErr.Field)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	fields := map[string]bool{}
+	for _, e := range err.(ConfigErrors) {
+		require.ErrorAs(t, e, &configErr)
+		fields[configErr.Field] = true
+	}
+	require.Equal(t, map[string]bool{"maxConcurrentStreams": true, "dial timeout": true}, fields)
+}
+
+func TestGetContext(t *testing.T) {
+	release := make(chan struct{})
+	p, err := New(*endpoint, MaxIdle(1), Lazy(true), Dial(func(address string) (*grpc.ClientConn, error) {
+		<-release
+		return DialTest(address)
+	}))
+	require.NoError(t, err)
+	defer p.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = p.GetContext(ctx)
+	require.ErrorIs(t, err, ErrGetTimeout)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Zero(t, p.Stats().Ref)
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = p.GetContext(canceled)
+	require.ErrorIs(t, err, context.Canceled)
+
+	// the growth abandoned by the callers still completes.
+	close(release)
+	require.Eventually(t, func() bool { return p.Stats().Current == 1 }, time.Second, 10*time.Millisecond)
+	borrowed, err := p.GetContext(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, borrowed.Close())
+}
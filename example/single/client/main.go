@@ -5,9 +5,6 @@ import (
 	"flag"
 	"fmt"
 	pb2 "github.com/chengyayu/grpcpool/example/single/pb"
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
-	"google.golang.org/grpc/keepalive"
 	"log"
 	"time"
 
@@ -19,21 +16,9 @@ var addr = flag.String("addr", "127.0.0.1:40000", "the address to connect to")
 func main() {
 	flag.Parse()
 
-	dialFn := func(address string) (*grpc.ClientConn, error) {
-		ctx, cancel := context.WithTimeout(context.Background(), pool.DialTimeout)
-		defer cancel()
-		return grpc.DialContext(ctx, address,
-			grpc.WithTransportCredentials(insecure.NewCredentials()),
-			grpc.WithBackoffMaxDelay(pool.BackoffMaxDelay),
-			grpc.WithInitialWindowSize(pool.InitialWindowSize),
-			grpc.WithInitialConnWindowSize(pool.InitialConnWindowSize),
-			grpc.WithDefaultCallOptions(grpc.MaxCallSendMsgSize(pool.MaxSendMsgSize)),
-			grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(pool.MaxRecvMsgSize)),
-			grpc.WithKeepaliveParams(keepalive.ClientParameters{
-				Time:                pool.KeepAliveTime,
-				Timeout:             pool.KeepAliveTimeout,
-				PermitWithoutStream: true,
-			}))
+	dialFn, err := pool.DefaultDialConfig().Build()
+	if err != nil {
+		log.Fatalf("invalid dial config: %v", err)
 	}
 
 	p, err := pool.New(*addr, pool.Dial(dialFn))
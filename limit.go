@@ -0,0 +1,72 @@
+// Copyright 2023 chengyayu. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpcpool
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tokenBucket limits the rate of the growth and one-shot dials.
+type tokenBucket struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// take takes at most n tokens and returns the number taken. rate is the tokens
+// refilled per second and burst is the bucket size, zero rate takes all n.
+func (b *tokenBucket) take(rate float64, burst, n int) int {
+	if rate == 0 {
+		return n
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	if b.last.IsZero() {
+		// 首次使用时令牌桶是满的
+		b.tokens = float64(burst)
+	} else {
+		b.tokens += rate * now.Sub(b.last).Seconds()
+	}
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+	b.last = now
+	if taken := int(b.tokens); taken < n {
+		n = taken
+	}
+	b.tokens -= float64(n)
+	return n
+}
+
+// reserveOneShot reserves a one-shot connection within options.maxOneShot.
+func (p *pool) reserveOneShot(o *options) bool {
+	for {
+		n := atomic.LoadInt32(&p.oneShots)
+		if o.maxOneShot > 0 && int(n) >= o.maxOneShot {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&p.oneShots, n, n+1) {
+			return true
+		}
+	}
+}
+
+// releaseOneShot releases a one-shot connection reserved by reserveOneShot.
+func (p *pool) releaseOneShot() {
+	atomic.AddInt32(&p.oneShots, -1)
+}
@@ -0,0 +1,81 @@
+// Copyright 2023 chengyayu. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpcpool
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	var b tokenBucket
+	require.Equal(t, 3, b.take(0, 0, 3))
+	require.Equal(t, 2, b.take(10, 2, 3))
+	require.Equal(t, 0, b.take(10, 2, 1))
+	time.Sleep(110 * time.Millisecond)
+	require.Equal(t, 1, b.take(10, 2, 3))
+}
+
+func TestMaxOneShot(t *testing.T) {
+	p, _, err := newPool(MaxIdle(1), MaxActive(1), MaxConcurrentStreams(1), Reuse(false), MaxOneShot(2))
+	require.NoError(t, err)
+	defer p.Close()
+
+	conns := make([]Conn, 4)
+	for i := range conns {
+		conns[i], err = p.Get()
+		require.NoError(t, err)
+	}
+	require.False(t, conns[0].(*conn).once)
+	require.True(t, conns[1].(*conn).once)
+	require.True(t, conns[2].(*conn).once)
+	// beyond MaxOneShot, the pooled connection is reused.
+	require.True(t, conns[3] == conns[0])
+
+	stats := p.Stats()
+	require.Equal(t, 2, stats.OneShots)
+	require.EqualValues(t, 1, stats.RejectedDials)
+	require.EqualValues(t, 3, stats.Overflows)
+
+	require.NoError(t, conns[1].Close())
+	require.Equal(t, 1, p.Stats().OneShots)
+	for _, c := range append(conns[:1], conns[2:]...) {
+		require.NoError(t, c.Close())
+	}
+	require.Zero(t, p.Stats().OneShots)
+
+	_, err = New(*endpoint, MaxOneShot(-1))
+	require.Error(t, err)
+}
+
+func TestDialRate(t *testing.T) {
+	p, nativePool, err := newPool(MaxIdle(1), MaxActive(8), MaxConcurrentStreams(1), DialRate(0.001, 1))
+	require.NoError(t, err)
+	defer p.Close()
+
+	conns := make([]Conn, 3)
+	for i := range conns {
+		conns[i], err = p.Get()
+		require.NoError(t, err)
+		defer conns[i].Close()
+	}
+	// the second Get takes the only token, the third one is served by the current connections.
+	require.EqualValues(t, 2, nativePool.current())
+	require.EqualValues(t, 2, p.Stats().RejectedDials)
+
+	_, err = New(*endpoint, DialRate(1, 0))
+	require.Error(t, err)
+}
@@ -0,0 +1,60 @@
+// Copyright 2023 chengyayu. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpcpool
+
+import "sync"
+
+// Notifier notifies subscribers when something connections depend on has changed.
+// A pool subscribes to a Notifier with the RedialOn option.
+type Notifier interface {
+	// Subscribe registers fn and returns a function to cancel the subscription.
+	Subscribe(fn func()) (cancel func())
+}
+
+// notifier is a reusable Notifier implementation.
+type notifier struct {
+	mu   sync.Mutex
+	next int
+	subs map[int]func()
+}
+
+// Subscribe see Notifier interface.
+func (n *notifier) Subscribe(fn func()) func() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.subs == nil {
+		n.subs = make(map[int]func())
+	}
+	id := n.next
+	n.next++
+	n.subs[id] = fn
+	return func() {
+		n.mu.Lock()
+		delete(n.subs, id)
+		n.mu.Unlock()
+	}
+}
+
+func (n *notifier) notify() {
+	n.mu.Lock()
+	fns := make([]func(), 0, len(n.subs))
+	for _, fn := range n.subs {
+		fns = append(fns, fn)
+	}
+	n.mu.Unlock()
+	for _, fn := range fns {
+		fn()
+	}
+}
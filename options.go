@@ -17,10 +17,8 @@
 package grpcpool
 
 import (
-	"context"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
-	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/credentials"
 	"time"
 )
 
@@ -59,6 +57,14 @@ const (
 	DftMaxActive = int(64)
 	// DftMaxConcurrentStreams see options.MaxConcurrentStreams
 	DftMaxConcurrentStreams = int(64)
+	// DftDialConcurrency see options.dialConcurrency
+	DftDialConcurrency = int(8)
+	// DftFillBackoff see options.fillBackoff
+	DftFillBackoff = 100 * time.Millisecond
+	// DftUnlimitedCap see options.unlimitedCap
+	DftUnlimitedCap = int(1024)
+	// DftMaintainInterval see options.maintainInterval
+	DftMaintainInterval = 5 * time.Second
 )
 
 // Option is an options setting function.
@@ -69,25 +75,266 @@ type options struct {
 	// dial is an application supplied function for creating and configuring a connection.
 	dial func(address string) (*grpc.ClientConn, error)
 
+	// dialConfig builds dial when the application doesn't supply one, see WithDialConfig.
+	dialConfig *DialConfig
+
+	// dialer is derived by init from dial or dialConfig, the pool dials with it.
+	// the options of a single dial are ignored when the application supplies dial.
+	dialer func(address string, opts ...grpc.DialOption) (*grpc.ClientConn, error)
+
+	// perRPCCredentials are attached to every connection built from dialConfig.
+	perRPCCredentials credentials.PerRPCCredentials
+
 	// maxIdle is a maximum number of idle connections in the pool.
+	// the pool shrinks to it when idle, and fills it initially unless lazy.
 	maxIdle int
 
+	// minIdle is a minimum number of connections the pool maintains even after failures.
+	// it may be zero.
+	minIdle int
+
+	// If lazy is true, New returns without dialing and the first Get dials.
+	lazy bool
+
 	// maxActive is a maximum number of connections allocated by the pool at a given time.
-	// When zero, there is no limit on the number of connections in the pool.
+	// When zero, there is no limit on the number of connections in the pool
+	// except the safety cap unlimitedCap.
 	maxActive int
 
+	// unlimitedCap is the safety cap of physical connections when maxActive is zero.
+	unlimitedCap int
+
+	// limit is the effective maximum of physical connections, derived by init:
+	// maxActive, or unlimitedCap when maxActive is unlimited.
+	limit int32
+
 	// maxConcurrentStreams limit on the number of concurrent streams to each single connection
 	maxConcurrentStreams int
 
+	// adaptiveStreams is the latency tolerance of the adaptive streams per connection,
+	// zero disables it, see AdaptiveStreams.
+	adaptiveStreams float64
+
 	// If reuse is true and the pool is at the MaxActive limit, then Get() reuse
 	// the connection to return, If reuse is false and the pool is at the maxActive limit,
 	// create a one-time connection to return.
 	reuse bool
+
+	// notifiers trigger a rolling re-dial of the pool, see RedialOn.
+	notifiers []Notifier
+
+	// dialConcurrency limits the number of parallel dials when filling the pool.
+	dialConcurrency int
+
+	// minStart is the minimum number of successful initial connections New requires.
+	// The remainder of maxIdle is filled in the background. zero means all of maxIdle.
+	minStart int
+
+	// fillBackoff and fillMaxBackoff are the initial and maximum delay between
+	// background fill attempts, the delay doubles after every failed attempt.
+	fillBackoff    time.Duration
+	fillMaxBackoff time.Duration
+
+	// asyncGrowth is the utilization of the logic connections in (0, 1] at which the
+	// pool starts growing in the background, Get never waits for the dials.
+	// zero disables it, the Get exceeding the capacity grows the pool synchronously.
+	asyncGrowth float64
+
+	// growth decides how many physical connections a growth round adds.
+	growth GrowthPolicy
+
+	// shrink decides which physical connections are closed when the pool becomes idle.
+	shrink ShrinkPolicy
+
+	// pick decides which physical connection a Get borrows.
+	pick PickPolicy
+
+	// outliers ejects the failing connections from the selection, nil disables it.
+	outliers *OutlierDetection
+
+	// maxOneShot limits the one-shot connections not closed yet when reuse is false,
+	// zero means unlimited.
+	maxOneShot int
+
+	// dialRate is the growth and one-shot dials per second, dialBurst is the most of them
+	// at once. zero dialRate means unlimited.
+	dialRate  float64
+	dialBurst int
+
+	// breakerThreshold is the number of consecutive failed dials opening the circuit,
+	// zero disables the circuit breaker. breakerTimeout is how long the circuit stays open.
+	breakerThreshold int
+	breakerTimeout   time.Duration
+
+	// block queues the Get exceeding the capacity at the limit until a borrowed connection is closed,
+	// instead of reusing a connection or dialing a one-shot connection, see Block.
+	block bool
+
+	// maxWaiting limits the length of the wait queue, zero means unlimited.
+	maxWaiting int
+
+	// waitOrder is the order the waiting Gets are served in.
+	waitOrder QueueOrder
+
+	// shards is the number of shards the physical connections are partitioned into,
+	// zero or one disables it, see Shards.
+	shards int
+
+	// onError is called with the misuses of the pool detected at runtime, e.g. a connection
+	// closed twice, and the errors of the background re-dials, nil ignores them. see OnError.
+	onError func(error)
+
+	// strict panics on the misuses of the pool instead of recovering from them, see Strict.
+	strict bool
+
+	// maintainInterval is the interval the pool replaces the shutdown connections
+	// and fills up to minIdle in the background.
+	maintainInterval time.Duration
+}
+
+func defaultOptions() *options {
+	dialConfig := DefaultDialConfig()
+	return &options{
+		dialConfig:           &dialConfig,
+		maxIdle:              DftMaxIdle,
+		maxActive:            DftMaxActive,
+		unlimitedCap:         DftUnlimitedCap,
+		maxConcurrentStreams: DftMaxConcurrentStreams,
+		reuse:                true,
+		dialConcurrency:      DftDialConcurrency,
+		fillBackoff:          DftFillBackoff,
+		fillMaxBackoff:       BackoffMaxDelay,
+		growth:               DoubleGrowth(),
+		shrink:               ShrinkToMaxIdle(),
+		maintainInterval:     DftMaintainInterval,
+	}
+}
+
+// init validates the settings and builds the dial function.
+func (o *options) init() error {
+	if err := o.validate(); err != nil {
+		return err
+	}
+	return o.initDialer()
+}
+
+// validate reports every invalid setting at once, a single one as *ConfigError and more of them
+// as ConfigErrors.
+func (o *options) validate() error {
+	var errs ConfigErrors
+	check := func(ok bool, field, reason string) {
+		if !ok {
+			errs = append(errs, configError(field, reason))
+		}
+	}
+	// maxActive 为 0 时不限制物理连接数，但不超过安全上限 unlimitedCap
+	limit := o.maxActive
+	if limit == 0 {
+		limit = o.unlimitedCap
+	}
+	check(o.maxIdle > 0 && o.maxActive >= 0 && o.unlimitedCap > 0 && o.maxIdle <= limit, "maximum", "")
+	o.limit = int32(limit)
+	check(o.maxConcurrentStreams > 0, "maxConcurrentStreams", "")
+	check(o.adaptiveStreams == 0 || o.adaptiveStreams > 1, "adaptive streams", "latency tolerance must be greater than 1")
+	check(o.minIdle >= 0 && o.minIdle <= o.maxIdle, "minIdle", "")
+	check(o.dialConcurrency > 0 && o.minStart >= 0 && o.minStart <= o.maxIdle, "initial fill", "")
+	check(o.fillBackoff > 0 && o.fillMaxBackoff >= o.fillBackoff, "fill backoff", "")
+	check(o.asyncGrowth >= 0 && o.asyncGrowth <= 1, "asyncGrowth", "")
+	check(o.growth != nil && o.shrink != nil, "growth or shrink policy", "")
+	check(o.pick >= RoundRobinPick && o.pick <= FastestPick, "pick policy", "")
+	check(o.maxOneShot >= 0, "maxOneShot", "")
+	check(o.dialRate >= 0 && (o.dialRate == 0 || o.dialBurst > 0), "dial rate", "")
+	check(o.breakerThreshold >= 0 && (o.breakerThreshold == 0 || o.breakerTimeout > 0), "circuit breaker", "")
+	if o.outliers != nil {
+		check(o.dialConfig != nil, "outlier detection", "requires the default dial or WithDialConfig")
+		errs.add(o.outliers.Validate())
+	}
+	check(o.maxWaiting >= 0, "maxWaiting", "must not be negative")
+	check(o.waitOrder >= FIFOOrder && o.waitOrder <= LIFOOrder, "wait order", "")
+	check(o.shards >= 0, "shards", "must not be negative")
+	check(o.maintainInterval > 0, "maintainInterval", "")
+	errs.add(o.validateDial())
+	return errs.err()
+}
+
+// validateDial checks the dial config, or the settings requiring it if the dial function is
+// supplied by the application.
+func (o *options) validateDial() error {
+	switch {
+	case o.dialConfig != nil:
+		if o.perRPCCredentials != nil && o.perRPCCredentials.RequireTransportSecurity() && o.dialConfig.Insecure {
+			return configError("per rpc credentials", "transport security is required")
+		}
+		return o.dialConfig.Validate()
+	case o.dial == nil:
+		return configError("dial", "")
+	case o.perRPCCredentials != nil:
+		return configError("per rpc credentials", "requires the default dial or WithDialConfig")
+	case o.adaptiveStreams > 0:
+		return configError("adaptive streams", "requires the default dial or WithDialConfig")
+	}
+	return nil
+}
+
+// initDialer builds the dial function from the dial config or the dial function of the application.
+func (o *options) initDialer() error {
+	if o.dialConfig == nil {
+		dial := o.dial
+		o.dialer = func(address string, _ ...grpc.DialOption) (*grpc.ClientConn, error) { return dial(address) }
+		return nil
+	}
+	var extra []grpc.DialOption
+	if o.perRPCCredentials != nil {
+		extra = append(extra, grpc.WithPerRPCCredentials(o.perRPCCredentials))
+	}
+	dial, err := o.dialConfig.build(extra...)
+	if err != nil {
+		return err
+	}
+	o.dialer = dial
+	return nil
+}
+
+// allNotifiers returns the notifiers of RedialOn and the per-RPC credentials implementing Notifier,
+// set by the PerRPCCredentials option or in the DialConfig.
+func (o *options) allNotifiers() []Notifier {
+	notifiers := o.notifiers[:len(o.notifiers):len(o.notifiers)]
+	if n, ok := o.perRPCCredentials.(Notifier); ok {
+		notifiers = append(notifiers, n)
+	}
+	if o.dialConfig != nil {
+		if n, ok := o.dialConfig.PerRPCCredentials.(Notifier); ok {
+			notifiers = append(notifiers, n)
+		}
+	}
+	return notifiers
+}
+
+// needGrow reports whether ref logic connections need more than the capacity of
+// the physical connections.
+func (o *options) needGrow(ref, capacity int32) bool {
+	if o.asyncGrowth > 0 {
+		return float64(ref) >= o.asyncGrowth*float64(capacity)
+	}
+	return ref > capacity
 }
 
 // Dial with factory function for *grpc.ClientConn
 func Dial(factoryFn func(address string) (*grpc.ClientConn, error)) Option {
-	return func(o *options) { o.dial = factoryFn }
+	return func(o *options) { o.dial, o.dialConfig = factoryFn, nil }
+}
+
+// WithDialConfig with a DialConfig the pool builds its factory function from.
+// Unlike Dial, it lets the pool attach options to every connection, e.g. PerRPCCredentials.
+func WithDialConfig(c DialConfig) Option {
+	return func(o *options) { o.dial, o.dialConfig = nil, &c }
+}
+
+// PerRPCCredentials attaches creds to every connection the pool dials. It requires
+// the default dial or WithDialConfig. When creds is a Notifier, e.g. RotatingCredentials,
+// the pool re-dials its connections on notification as RedialOn does.
+func PerRPCCredentials(creds credentials.PerRPCCredentials) Option {
+	return func(o *options) { o.perRPCCredentials = creds }
 }
 
 // MaxIdle with pool maxIdle
@@ -95,34 +342,164 @@ func MaxIdle(maxIdle int) Option {
 	return func(o *options) { o.maxIdle = maxIdle }
 }
 
+// MinIdle with pool minIdle
+func MinIdle(minIdle int) Option {
+	return func(o *options) { o.minIdle = minIdle }
+}
+
+// Lazy with pool lazy
+func Lazy(lazy bool) Option {
+	return func(o *options) { o.lazy = lazy }
+}
+
+// MaintainInterval with pool maintainInterval
+func MaintainInterval(d time.Duration) Option {
+	return func(o *options) { o.maintainInterval = d }
+}
+
 // MaxActive with pool maxActive
 func MaxActive(maxActive int) Option {
 	return func(o *options) { o.maxActive = maxActive }
 }
 
+// UnlimitedCap with pool unlimitedCap
+func UnlimitedCap(n int) Option {
+	return func(o *options) { o.unlimitedCap = n }
+}
+
 // MaxConcurrentStreams with pool maxConcurrentStreams
 func MaxConcurrentStreams(maxConcurrentStreams int) Option {
 	return func(o *options) { o.maxConcurrentStreams = maxConcurrentStreams }
 }
 
+// AdaptiveStreams adjusts the streams each connection serves between 1 and MaxConcurrentStreams
+// by the observed RPCs, additive increase and multiplicative decrease. An RPC failed with
+// ResourceExhausted or REFUSED_STREAM, or slower than tolerance times the connection's baseline
+// latency, halves the streams, the others raise it gradually. The pool grows when the
+// connections are saturated. tolerance must be greater than 1, zero disables it.
+// It requires the default dial or WithDialConfig.
+func AdaptiveStreams(tolerance float64) Option {
+	return func(o *options) { o.adaptiveStreams = tolerance }
+}
+
 // Reuse with pool reuse
 func Reuse(reuse bool) Option {
 	return func(o *options) { o.reuse = reuse }
 }
 
-// DftDial return a grpc connection with defined configurations.
+// DialConcurrency with pool dialConcurrency
+func DialConcurrency(n int) Option {
+	return func(o *options) { o.dialConcurrency = n }
+}
+
+// MinStart with pool minStart
+func MinStart(n int) Option {
+	return func(o *options) { o.minStart = n }
+}
+
+// FillBackoff with pool fillBackoff and fillMaxBackoff
+func FillBackoff(backoff, maxBackoff time.Duration) Option {
+	return func(o *options) { o.fillBackoff, o.fillMaxBackoff = backoff, maxBackoff }
+}
+
+// AsyncGrowth with pool asyncGrowth, e.g. AsyncGrowth(0.8) starts growing at 80% utilization.
+func AsyncGrowth(threshold float64) Option {
+	return func(o *options) { o.asyncGrowth = threshold }
+}
+
+// Growth with pool growth policy, e.g. LinearGrowth(4)
+func Growth(policy GrowthPolicy) Option {
+	return func(o *options) { o.growth = policy }
+}
+
+// Shrink with pool shrink policy, e.g. LRUShrink()
+func Shrink(policy ShrinkPolicy) Option {
+	return func(o *options) { o.shrink = policy }
+}
+
+// Pick with the policy deciding which physical connection a Get borrows, RoundRobinPick by default.
+func Pick(policy PickPolicy) Option {
+	return func(o *options) { o.pick = policy }
+}
+
+// DetectOutliers ejects the physical connections failing too many RPCs from the selection
+// with exponential back-off, and replaces the ones staying bad, see OutlierDetection.
+// It requires the default dial or WithDialConfig.
+func DetectOutliers(d OutlierDetection) Option {
+	return func(o *options) { o.outliers = &d }
+}
+
+// MaxOneShot limits the one-shot connections not closed yet when Reuse is false. Beyond it,
+// Get reuses a pooled connection instead of dialing. Zero means unlimited.
+func MaxOneShot(n int) Option {
+	return func(o *options) { o.maxOneShot = n }
+}
+
+// DialRate limits the dials for growth and one-shot connections to rate per second with
+// bursts of burst dials, shared by both. A rate limited one-shot Get reuses a pooled connection,
+// a rate limited growth serves from the current connections, or fails with ErrDialRateLimited
+// if there is none. Zero rate means unlimited.
+func DialRate(rate float64, burst int) Option {
+	return func(o *options) { o.dialRate, o.dialBurst = rate, burst }
+}
+
+// CircuitBreaker opens the circuit after threshold consecutive failed dials. While it's open,
+// the dials for growth, one-shot connections and replacements fail fast with ErrCircuitOpen
+// instead of waiting for the dial timeout. After timeout, a single probe dial is allowed,
+// its success closes the circuit and its failure opens it again. Zero threshold disables it.
+func CircuitBreaker(threshold int, timeout time.Duration) Option {
+	return func(o *options) { o.breakerThreshold, o.breakerTimeout = threshold, timeout }
+}
+
+// Block makes the Get exceeding the capacity when the pool is at the MaxActive limit wait until a
+// borrowed connection is closed, instead of reusing a connection or dialing a one-shot connection
+// as Reuse decides. The closed connection is handed over to the waiting Gets in WaitOrder, and
+// GetContext gives up waiting when its context is done.
+func Block(block bool) Option {
+	return func(o *options) { o.block = block }
+}
+
+// MaxWaiting limits the Gets waiting in the blocking mode, beyond it Get fails fast with
+// ErrPoolExhausted to shed the load. Zero means unlimited.
+func MaxWaiting(n int) Option {
+	return func(o *options) { o.maxWaiting = n }
+}
+
+// WaitOrder with the order the waiting Gets are served in the blocking mode, FIFOOrder by default.
+func WaitOrder(order QueueOrder) Option {
+	return func(o *options) { o.waitOrder = order }
+}
+
+// Shards partitions the physical connections into n shards by their index, for the hosts with many
+// cores. A Get borrows from the shard of the P it's running on, and steals from the other shards when
+// the connections of its shard are saturated, so the Gets on different cores rarely contend on the
+// same connection. Zero or one disables it. It can't be changed by Reconfigure.
+func Shards(n int) Option {
+	return func(o *options) { o.shards = n }
+}
+
+// OnError calls fn with the misuses of the pool detected at runtime, i.e. ErrNegativeRef when
+// a connection is closed more than once and ErrRefOverflow when too many connections are borrowed.
+// The pool recovers from them by clamping the reference count, they are counted by Stats().RefErrors.
+// fn is also called with the errors of the re-dials triggered by RedialOn, counted by Stats().RedialErrors,
+// the pool keeps the old connections serving and retries on the next notification. fn must not block.
+func OnError(fn func(error)) Option {
+	return func(o *options) { o.onError = fn }
+}
+
+// Strict panics on the misuses reported to OnError, to find the bugs in testing.
+func Strict(strict bool) Option {
+	return func(o *options) { o.strict = strict }
+}
+
+// RedialOn re-dials every physical connection of the pool in the background when n notifies,
+// e.g. a CertWatcher after the certificates are rotated, so new handshakes use the new identity.
+// The notifications during a re-dial start one more round after it, the errors are reported to OnError.
+func RedialOn(n Notifier) Option {
+	return func(o *options) { o.notifiers = append(o.notifiers, n) }
+}
+
+// DftDial return a grpc connection with defined configurations, see DefaultDialConfig.
 func DftDial(address string) (*grpc.ClientConn, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), DialTimeout)
-	defer cancel()
-	return grpc.DialContext(ctx, address,
-		grpc.WithTransportCredentials(insecure.NewCredentials()),
-		grpc.WithBackoffMaxDelay(BackoffMaxDelay),
-		grpc.WithInitialWindowSize(InitialWindowSize),
-		grpc.WithInitialConnWindowSize(InitialConnWindowSize),
-		grpc.WithDefaultCallOptions(grpc.MaxCallSendMsgSize(MaxSendMsgSize), grpc.MaxCallRecvMsgSize(MaxRecvMsgSize)),
-		grpc.WithKeepaliveParams(keepalive.ClientParameters{
-			Time:                KeepAliveTime,
-			Timeout:             KeepAliveTimeout,
-			PermitWithoutStream: true,
-		}))
+	return DefaultDialConfig().dial(address)
 }
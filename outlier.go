@@ -0,0 +1,160 @@
+// Copyright 2023 chengyayu. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpcpool
+
+import (
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// OutlierDetection ejects the physical connections failing too many RPCs from the selection
+// for a while, see DetectOutliers. The failures are the RPCs ended with Unavailable,
+// DeadlineExceeded or Internal. The connections are evaluated every MaintainInterval.
+type OutlierDetection struct {
+	// ErrorRate ejects a connection whose failures in an interval reach such a rate, in (0, 1].
+	ErrorRate float64
+
+	// MinRequests is the minimum number of RPCs in an interval to evaluate a connection.
+	MinRequests int
+
+	// BaseEjection is the duration of the first ejection, it doubles for every consecutive
+	// ejection up to MaxEjection. An interval without failures resets it.
+	BaseEjection time.Duration
+	MaxEjection  time.Duration
+
+	// MaxEjections replaces a connection ejected more than such times in a row with a newly
+	// dialed one. Zero never replaces.
+	MaxEjections int
+
+	// MaxEjectedPercent limits the percent of the connections ejected at the same time.
+	MaxEjectedPercent int
+}
+
+// DefaultOutlierDetection returns the recommended outlier detection.
+func DefaultOutlierDetection() OutlierDetection {
+	return OutlierDetection{
+		ErrorRate:         0.5,
+		MinRequests:       10,
+		BaseEjection:      30 * time.Second,
+		MaxEjection:       5 * time.Minute,
+		MaxEjections:      3,
+		MaxEjectedPercent: 50,
+	}
+}
+
+// Validate reports invalid settings.
+func (d OutlierDetection) Validate() error {
+	if d.ErrorRate <= 0 || d.ErrorRate > 1 || d.MinRequests <= 0 {
+		return configError("outlier detection", "error rate must be in (0, 1] and min requests positive")
+	}
+	if d.BaseEjection <= 0 || d.MaxEjection < d.BaseEjection {
+		return configError("outlier detection", "invalid ejection duration")
+	}
+	if d.MaxEjections < 0 || d.MaxEjectedPercent < 0 || d.MaxEjectedPercent > 100 {
+		return configError("outlier detection", "invalid ejection limit")
+	}
+	return nil
+}
+
+// ejection returns the duration of the n-th consecutive ejection.
+func (d OutlierDetection) ejection(n int) time.Duration {
+	e := d.BaseEjection
+	for i := 1; i < n && e < d.MaxEjection; i++ {
+		e *= 2
+	}
+	if e > d.MaxEjection {
+		e = d.MaxEjection
+	}
+	return e
+}
+
+// failure reports whether err counts as a failure of the connection.
+func failure(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Internal:
+		return true
+	}
+	return false
+}
+
+// now returns the unix nano to check the ejections at, the far future when the detection is
+// disabled so that no connection is ejected.
+func (o *options) now() int64 {
+	if o.outliers == nil {
+		return math.MaxInt64
+	}
+	return time.Now().UnixNano()
+}
+
+// detectOutliers ejects the connections failing too many RPCs in the last interval,
+// and replaces the ones ejected too many times in a row.
+func (p *pool) detectOutliers() {
+	d := p.options().outliers
+	if d == nil {
+		return
+	}
+	now := time.Now()
+
+	type outlier struct {
+		index int32
+		conn  *conn
+	}
+	var replaces []outlier
+	p.Lock()
+	conns := p.snapshot()
+	current := len(conns)
+	ejected := 0
+	for _, c := range conns {
+		if c.ejected(now.UnixNano()) {
+			ejected++
+		}
+	}
+	for i, c := range conns {
+		if c.tracker == nil {
+			continue
+		}
+		calls, failures := c.tracker.reset()
+		if c.ejected(now.UnixNano()) || int(calls) < d.MinRequests {
+			continue
+		}
+		if float64(failures) < d.ErrorRate*float64(calls) {
+			if failures == 0 {
+				c.ejections = 0
+			}
+			continue
+		}
+		c.ejections++
+		if d.MaxEjections > 0 && c.ejections > d.MaxEjections {
+			replaces = append(replaces, outlier{int32(i), c})
+			continue
+		}
+		// 同时被驱逐的连接数不超过 MaxEjectedPercent
+		if (ejected+1)*100 > d.MaxEjectedPercent*current {
+			continue
+		}
+		ejected++
+		atomic.StoreInt64(&c.ejectedUntil, now.Add(d.ejection(c.ejections)).UnixNano())
+		atomic.AddUint64(&p.ejections, 1)
+	}
+	p.Unlock()
+
+	for _, r := range replaces {
+		// 失败则等待下个周期重试
+		_ = p.replace(r.index, r.conn)
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2023 chengyayu. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpcpool
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/status"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestOutlierDetectionValidate(t *testing.T) {
+	d := DefaultOutlierDetection()
+	require.NoError(t, d.Validate())
+	require.Equal(t, d.BaseEjection, d.ejection(1))
+	require.Equal(t, 4*d.BaseEjection, d.ejection(3))
+	require.Equal(t, d.MaxEjection, d.ejection(10))
+
+	d.ErrorRate = 0
+	require.Error(t, d.Validate())
+	_, err := New(*endpoint, Dial(DialTest), DetectOutliers(DefaultOutlierDetection()))
+	require.Error(t, err)
+}
+
+func TestDetectOutliers(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	startEchoServer(t, lis, grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		return nil, status.Error(codes.Internal, "broken")
+	}))
+
+	d := DefaultOutlierDetection()
+	d.MaxEjections = 2
+	p, err := New(lis.Addr().String(), MaxIdle(2), DetectOutliers(d), MaintainInterval(time.Hour))
+	require.NoError(t, err)
+	defer p.Close()
+	nativePool := p.(*pool)
+	bad, good := nativePool.snapshot()[0], nativePool.snapshot()[1]
+
+	// the failed RPCs are counted.
+	borrowed, err := p.Get()
+	require.NoError(t, err)
+	require.Error(t, say(borrowed))
+	require.NoError(t, borrowed.Close())
+	calls, failures := borrowed.(*conn).tracker.reset()
+	require.EqualValues(t, 1, calls)
+	require.EqualValues(t, 1, failures)
+
+	fail := func(c *conn, failures int32) {
+		atomic.StoreInt32(&c.tracker.calls, 10)
+		atomic.StoreInt32(&c.tracker.failures, failures)
+	}
+	fail(bad, 6)
+	fail(good, 4)
+	nativePool.detectOutliers()
+	stats := p.Stats()
+	require.EqualValues(t, 1, stats.Ejections)
+	require.True(t, stats.Conns[0].Ejected)
+	require.False(t, stats.Conns[1].Ejected)
+
+	// the ejected connection is skipped by every pick policy.
+	for _, policy := range []PickPolicy{RoundRobinPick, LeastLoadedPick, FastestPick} {
+		require.NoError(t, p.Reconfigure(Pick(policy)))
+		for i := 0; i < 10; i++ {
+			borrowed, err := p.Get()
+			require.NoError(t, err)
+			require.True(t, borrowed.(*conn) == good, "policy %d round %d", policy, i)
+			require.NoError(t, borrowed.Close())
+		}
+	}
+
+	// at most half of the connections are ejected.
+	fail(good, 10)
+	nativePool.detectOutliers()
+	require.False(t, p.Stats().Conns[1].Ejected)
+
+	// the connection is replaced after being ejected more than MaxEjections times in a row.
+	for i := 0; i < 2; i++ {
+		atomic.StoreInt64(&bad.ejectedUntil, 0)
+		fail(bad, 10)
+		nativePool.detectOutliers()
+	}
+	require.True(t, nativePool.snapshot()[0] != bad)
+	require.Equal(t, connectivity.Shutdown, bad.cc.GetState())
+	require.False(t, p.Stats().Conns[0].Ejected)
+}
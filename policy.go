@@ -0,0 +1,143 @@
+// Copyright 2023 chengyayu. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpcpool
+
+import (
+	"sort"
+	"time"
+)
+
+// GrowthPolicy decides how many physical connections a growth round adds.
+type GrowthPolicy interface {
+	// Increment returns the number of connections to add to current ones.
+	// The pool adds at least one and caps the result by maxActive.
+	Increment(current, maxActive int) int
+}
+
+// GrowthFunc is an adapter to use an ordinary function as a GrowthPolicy.
+type GrowthFunc func(current, maxActive int) int
+
+// Increment see GrowthPolicy interface.
+func (f GrowthFunc) Increment(current, maxActive int) int {
+	return f(current, maxActive)
+}
+
+// DoubleGrowth doubles the physical connections, the default policy.
+func DoubleGrowth() GrowthPolicy {
+	return GrowthFunc(func(current, maxActive int) int { return current })
+}
+
+// LinearGrowth adds step physical connections every round.
+func LinearGrowth(step int) GrowthPolicy {
+	return GrowthFunc(func(current, maxActive int) int { return step })
+}
+
+// PercentGrowth adds percent of the current physical connections every round, rounded up.
+func PercentGrowth(percent int) GrowthPolicy {
+	return GrowthFunc(func(current, maxActive int) int { return (current*percent + 99) / 100 })
+}
+
+// ShrinkPolicy decides which physical connections are closed when the pool
+// becomes idle with more than maxIdle physical connections.
+type ShrinkPolicy interface {
+	// Evict returns the indexes of the connections to close. conns are in pool order.
+	// The pool ignores the indexes which would leave less than maxIdle connections.
+	Evict(conns []ConnStat, maxIdle int) []int
+}
+
+// ShrinkFunc is an adapter to use an ordinary function as a ShrinkPolicy.
+type ShrinkFunc func(conns []ConnStat, maxIdle int) []int
+
+// Evict see ShrinkPolicy interface.
+func (f ShrinkFunc) Evict(conns []ConnStat, maxIdle int) []int {
+	return f(conns, maxIdle)
+}
+
+// ShrinkToMaxIdle closes the connections beyond maxIdle at once, the default policy.
+func ShrinkToMaxIdle() ShrinkPolicy {
+	return StepDownShrink(0)
+}
+
+// StepDownShrink closes at most step connections beyond maxIdle every time the pool
+// becomes idle, from the highest index. Non-positive step closes all of them.
+func StepDownShrink(step int) ShrinkPolicy {
+	return ShrinkFunc(func(conns []ConnStat, maxIdle int) []int {
+		n := len(conns) - maxIdle
+		if n <= 0 {
+			return nil
+		}
+		if step > 0 && step < n {
+			n = step
+		}
+		evict := make([]int, 0, n)
+		for i := len(conns) - 1; len(evict) < n; i-- {
+			evict = append(evict, conns[i].Index)
+		}
+		return evict
+	})
+}
+
+// LRUShrink closes the least recently used connections beyond maxIdle,
+// by the later of the last release and the last RPC activity.
+func LRUShrink() ShrinkPolicy {
+	return sortedShrink(func(a, b ConnStat) bool { return lastUse(a).Before(lastUse(b)) })
+}
+
+func lastUse(c ConnStat) time.Time {
+	if c.LastActive.After(c.LastUsed) {
+		return c.LastActive
+	}
+	return c.LastUsed
+}
+
+// OldestShrink closes the oldest connections beyond maxIdle.
+func OldestShrink() ShrinkPolicy {
+	return sortedShrink(func(a, b ConnStat) bool { return a.CreatedAt.Before(b.CreatedAt) })
+}
+
+// sortedShrink closes the connections beyond maxIdle which come first by less.
+func sortedShrink(less func(a, b ConnStat) bool) ShrinkPolicy {
+	return ShrinkFunc(func(conns []ConnStat, maxIdle int) []int {
+		n := len(conns) - maxIdle
+		if n <= 0 {
+			return nil
+		}
+		sorted := append([]ConnStat(nil), conns...)
+		sort.SliceStable(sorted, func(i, j int) bool { return less(sorted[i], sorted[j]) })
+		evict := make([]int, 0, n)
+		for _, c := range sorted[:n] {
+			evict = append(evict, c.Index)
+		}
+		return evict
+	})
+}
+
+// PickPolicy decides which physical connection a Get borrows.
+type PickPolicy int
+
+const (
+	// RoundRobinPick borrows the connections in turn, the default policy.
+	RoundRobinPick PickPolicy = iota
+
+	// LeastLoadedPick borrows the connection with the fewest borrowed references or in-flight RPCs,
+	// whichever is larger.
+	LeastLoadedPick
+
+	// FastestPick borrows the faster one of two random connections, weighted by their
+	// load as LeastLoadedPick, so a connection behind a slow backend or a congested path
+	// gets less traffic. The latency is the moving average of the unary RPCs, which requires
+	// the default dial or WithDialConfig, otherwise it behaves like LeastLoadedPick between the two.
+	FastestPick
+)
@@ -0,0 +1,91 @@
+// Copyright 2023 chengyayu. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpcpool
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestGrowthPolicy(t *testing.T) {
+	require.Equal(t, 4, DoubleGrowth().Increment(4, 64))
+	require.Equal(t, 2, LinearGrowth(2).Increment(4, 64))
+	require.Equal(t, 2, PercentGrowth(50).Increment(4, 64))
+	require.Equal(t, 1, PercentGrowth(10).Increment(4, 64))
+
+	p, nativePool, err := newPool(MaxIdle(2), MaxActive(8), MaxConcurrentStreams(1), Growth(LinearGrowth(1)))
+	require.NoError(t, err)
+	defer p.Close()
+
+	for i := 0; i < 3; i++ {
+		conn, err := p.Get()
+		require.NoError(t, err)
+		defer conn.Close()
+	}
+	require.EqualValues(t, 3, nativePool.current())
+}
+
+func TestShrinkPolicy(t *testing.T) {
+	now := time.Now()
+	conns := []ConnStat{
+		{Index: 0, CreatedAt: now, LastUsed: now.Add(3 * time.Second)},
+		{Index: 1, CreatedAt: now.Add(-time.Second), LastUsed: now.Add(time.Second)},
+		{Index: 2, CreatedAt: now.Add(time.Second), LastUsed: now.Add(2 * time.Second)},
+		{Index: 3, CreatedAt: now.Add(2 * time.Second)},
+	}
+	require.Equal(t, []int{3, 2}, ShrinkToMaxIdle().Evict(conns, 2))
+	require.Equal(t, []int{3}, StepDownShrink(1).Evict(conns, 2))
+	require.Equal(t, []int{3, 1}, LRUShrink().Evict(conns, 2))
+	require.Equal(t, []int{1, 0}, OldestShrink().Evict(conns, 2))
+
+	// maxIdle may be raised above the connections by a concurrent Reconfigure.
+	for _, policy := range []ShrinkPolicy{ShrinkToMaxIdle(), StepDownShrink(1), LRUShrink(), OldestShrink()} {
+		require.Empty(t, policy.Evict(conns[:2], 4))
+		require.Empty(t, policy.Evict(conns, 4))
+	}
+}
+
+func TestLRUShrink(t *testing.T) {
+	p, nativePool, err := newPool(MaxIdle(2), MaxActive(4), MaxConcurrentStreams(1), Shrink(LRUShrink()))
+	require.NoError(t, err)
+	defer p.Close()
+
+	var conns []Conn
+	for i := 0; i < 4; i++ {
+		conn, err := p.Get()
+		require.NoError(t, err)
+		conns = append(conns, conn)
+	}
+	require.EqualValues(t, 4, nativePool.current())
+
+	// conns[1] and conns[2] are released last, they are kept.
+	c1, c2 := conns[1].(*conn), conns[2].(*conn)
+	conns[0].Close()
+	conns[3].Close()
+	time.Sleep(time.Millisecond)
+	conns[1].Close()
+	conns[2].Close()
+
+	require.EqualValues(t, 2, nativePool.current())
+	require.ElementsMatch(t, []*conn{c1, c2}, nativePool.snapshot())
+
+	// a shrink decided before a Reconfigure raising maxIdle keeps the connections.
+	require.NoError(t, p.Reconfigure(MaxIdle(4)))
+	nativePool.Lock()
+	nativePool.shrink()
+	nativePool.Unlock()
+	require.Len(t, nativePool.snapshot(), 2)
+}
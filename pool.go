@@ -17,17 +17,18 @@
 package grpcpool
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
 	"math"
+	"math/rand"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
-// ErrClosed is the error resulting if the pool is closed via pool.Close().
-var ErrClosed = errors.New("pool is closed")
-
 // Pool interface describes a pool implementation.
 // An ideal pool is thread-safe and easy to use.
 type Pool interface {
@@ -36,31 +37,76 @@ type Pool interface {
 	// be counted as an error. we guarantee the conn.Value() isn't nil when conn isn't nil.
 	Get() (Conn, error)
 
+	// GetContext is Get but gives up waiting for the growth of the pool, or for a connection
+	// in the blocking mode, when ctx is done. It returns ErrGetTimeout if the deadline of ctx
+	// expires, or ctx.Err() if ctx is canceled.
+	GetContext(ctx context.Context) (Conn, error)
+
 	// Close closes the pool and all its connections. After Close() the pool is
-	// no longer usable. You can't make concurrent calls Close and Get method.
-	// It will be cause panic.
+	// no longer usable, Get returns ErrClosed. It's safe to call Close concurrently
+	// with Get and with the borrowers closing their connections.
 	Close()
 
 	// Status returns the current status of the pool.
 	Status() string
+
+	// Stats returns the statistics of the pool for monitoring.
+	Stats() Stats
+
+	// Redial replaces every physical connection with a newly dialed one, one by one.
+	// The replaced connections are closed after the borrowers release them,
+	// so it doesn't interrupt the in-flight RPCs.
+	Redial() error
+
+	// Reconfigure applies opts to the live pool, e.g. MaxIdle, MaxActive,
+	// MaxConcurrentStreams and Reuse. The update is validated as a whole,
+	// the pool keeps the old options if it's invalid. The connections beyond
+	// the new limit are closed after the borrowers release them.
+	Reconfigure(opts ...Option) error
 }
 
 type pool struct {
-	// atomic, used to get connection random.
-	index uint32
+	// atomic, the Gets exceeding the capacity when the pool is at the limit.
+	// keep the 64-bit fields first to be 64-bit aligned.
+	overflows uint64
+
+	// atomic, the number of times a connection was ejected as an outlier.
+	ejections uint64
+
+	// atomic, the growth and one-shot dials rejected by MaxOneShot and DialRate.
+	rejectedDials uint64
+
+	// atomic, the misuses of the reference count reported to options.onError.
+	refErrors uint64
+
+	// atomic, the failed background re-dials reported to options.onError.
+	redialErrors uint64
 
-	// atomic, the current physical connection of pool.
-	current int32
+	// atomic, the Gets queued in the blocking mode, their total wait in nanoseconds,
+	// and the Gets rejected because the queue was full.
+	waits    uint64
+	waitTime int64
+	shed     uint64
 
-	// atomic, the using logic connection of pool
+	// used to get connection round robin. it's updated by every Get,
+	// so it's padded to its own cache line.
+	_     [cacheLine]byte
+	index paddedInt32
+
+	// the using logic connection of pool, striped by P.
 	// logic connection = physical connection * options.maxConcurrentStreams
-	ref int32
+	ref stripedCounter
 
-	// pool options
-	opt options
+	// the in-flight RPCs on the tracked physical connections, striped by P.
+	// a borrowed connection may carry any number of RPCs, so it complements ref.
+	inflight stripedCounter
 
-	// all of created physical connections.
-	conns []*conn
+	// pool options, *options. it's replaced as a whole by Reconfigure.
+	opt atomic.Value
+
+	// the physical connections in use, read without locking and replaced as a whole
+	// by the writers holding the lock, see connSet.
+	conns atomic.Pointer[connSet]
 
 	// the server address is to create connection.
 	address string
@@ -68,50 +114,118 @@ type pool struct {
 	// closed set true when Close is called.
 	closed int32
 
-	// control the atomic var current's concurrent read write.
-	sync.RWMutex
+	// serialize the writers of conns.
+	sync.Mutex
+
+	// the shards of the pool, fixed when it's created. nil if it's not sharded, see Shards.
+	shards []shard
+
+	// serialize the rolling re-dials.
+	redialMu sync.Mutex
+
+	// atomic, the notifications not served by a background re-dial yet, see redialAsync.
+	redialRequests int32
+
+	// cancel the subscriptions of options.notifiers.
+	unsubscribes []func()
+
+	// closed when Close is called, to stop the background goroutines.
+	done chan struct{}
+
+	// the in-flight growth round, shared by the concurrent Get calls.
+	growMu  sync.Mutex
+	growing *growCall
+
+	// atomic, set while a background growth round is running.
+	asyncGrowing int32
+
+	// breaker fails the dials fast while the server is unreachable.
+	breaker breaker
+
+	// limiter limits the rate of the growth and one-shot dials.
+	limiter tokenBucket
+
+	// atomic, the one-shot connections not closed yet.
+	oneShots int32
+
+	// atomic, the consecutive failed dials, see DialError.Attempt.
+	dialFailures int32
+
+	// queue is the Gets waiting for a connection in the blocking mode, see Block.
+	queue waitQueue
 }
 
-func New(address string, opts ...Option) (Pool, error) {
-	o := options{
-		dial:                 DftDial,
-		maxIdle:              DftMaxIdle,
-		maxActive:            DftMaxActive,
-		maxConcurrentStreams: DftMaxConcurrentStreams,
-		reuse:                true,
-	}
+// connSet is an immutable snapshot of the physical connections in use. The writers copy it,
+// modify the copy and store it as a whole, so the readers, e.g. Get, always see a consistent set.
+// The connections removed from the set are retired, so a reader holding an old snapshot
+// never borrows a closed connection.
+type connSet struct {
+	// conns are the physical connections in use, none is nil. its capacity is the storage
+	// of the pool, maxActive, or grows up to options.limit when maxActive is unlimited.
+	conns []*conn
+
+	// shards partitions conns by pool.shards, nil if the pool is not sharded.
+	shards [][]*conn
+}
+
+// growCall is a growth round, done is closed after err is set.
+type growCall struct {
+	done chan struct{}
+	err  error
+}
 
+func New(address string, opts ...Option) (Pool, error) {
+	o := defaultOptions()
 	for _, opt := range opts {
-		opt(&o)
+		opt(o)
 	}
 
 	if address == "" {
-		return nil, errors.New("invalid address settings")
-	}
-	if o.dial == nil {
-		return nil, errors.New("invalid dial settings")
+		return nil, configError("address", "")
 	}
-	if o.maxIdle <= 0 || o.maxActive <= 0 || o.maxIdle > o.maxActive {
-		return nil, errors.New("invalid maximum settings")
-	}
-	if o.maxConcurrentStreams <= 0 {
-		return nil, errors.New("invalid maxConcurrentStreams settings")
+	if err := o.init(); err != nil {
+		return nil, err
 	}
 
+	storage := o.maxActive
+	if storage == 0 {
+		storage = o.maxIdle
+	}
 	p := &pool{
-		current: int32(o.maxIdle),
-		opt:     o,
-		conns:   make([]*conn, o.maxActive),
-		address: address,
+		ref:      newStripedCounter(),
+		inflight: newStripedCounter(),
+		address:  address,
+		done:     make(chan struct{}),
+		shards:   newShards(o.shards),
 	}
+	p.opt.Store(o)
+	p.store(make([]*conn, 0, storage))
 
-	for i := 0; i < p.opt.maxIdle; i++ {
-		c, err := p.opt.dial(address)
-		if err != nil {
+	if o.lazy {
+		// 懒加载：不拨号立即返回，由首次 Get 拨号，minIdle 在后台补齐。
+		if o.minIdle > 0 {
+			go p.fill(o.minIdle)
+		}
+	} else {
+		// 并发拨号填充初始连接，成功数不低于 minStart 即可启动，剩余部分后台补齐。
+		minStart := o.minStart
+		if minStart == 0 {
+			minStart = o.maxIdle
+		}
+		cs, err := p.dialN(o.maxIdle)
+		p.publish(cs)
+		if len(cs) < minStart {
 			p.Close()
-			return nil, fmt.Errorf("dial is not able to fill the pool: %s", err)
+			return nil, fmt.Errorf("dial is not able to fill the pool: %w", err)
 		}
-		p.conns[i] = p.wrapConn(c, false)
+		if len(cs) < o.maxIdle {
+			go p.fill(o.maxIdle)
+		}
+	}
+	go p.maintain()
+	for _, n := range o.allNotifiers() {
+		// 失败时保留旧连接继续服务，下次通知时重试。
+		p.unsubscribes = append(p.unsubscribes, n.Subscribe(p.redialAsync))
 	}
 	//log.Printf("new pool success: %v\n", p.Status())
 
@@ -119,126 +233,856 @@ func New(address string, opts ...Option) (Pool, error) {
 }
 
 func (p *pool) Get() (Conn, error) {
-	nextRef := p.incrRef()
-	p.RLock()
-	current := atomic.LoadInt32(&p.current)
-	p.RUnlock()
-	if current == 0 {
+	return p.GetContext(context.Background())
+}
+
+func (p *pool) GetContext(ctx context.Context) (Conn, error) {
+	if ctx.Err() != nil {
+		return nil, getError(ctx)
+	}
+	if atomic.LoadInt32(&p.closed) == 1 {
 		return nil, ErrClosed
 	}
+	p.incrRef()
+	o := p.options()
+
+	// 快速路径：选中的物理连接仍有余量时直接借出，无需汇总全局计数，也无需扩容。
+	if c := p.tryPick(o); c != nil {
+		return c, nil
+	}
+
+	conns := p.snapshot()
+	current, capacity := int32(len(conns)), o.capacity(conns)
+	// 需求取借出的逻辑连接数与实际在途 RPC 数（含本次）中的较大者
+	demand := p.demand(p.ref.load())
+
+	// 异步扩容模式，懒加载的连接池尚无物理连接时仍同步扩容
+	if o.asyncGrowth > 0 && current > 0 {
+		return p.getAsync(ctx, o, demand, current, capacity)
+	}
 
 	// 当前逻辑连接数未被占满
-	if nextRef <= current*int32(p.opt.maxConcurrentStreams) {
-		next := atomic.AddUint32(&p.index, 1) % uint32(current)
-		return p.conns[next], nil
+	if demand <= capacity {
+		return p.pickFree()
 	}
 
 	// 物理连接数已达上限
-	if current == int32(p.opt.maxActive) {
-		// 开启了连接复用，从池中拿一个物理连接
-		if p.opt.reuse {
-			next := atomic.AddUint32(&p.index, 1) % uint32(current)
-			return p.conns[next], nil
-		}
-		// 未开启连接复用，创建一次性物理连接
-		c, err := p.opt.dial(p.address)
-		return p.wrapConn(c, true), err
+	if current >= o.limit {
+		return p.overflow(ctx, o)
 	}
 
 	// 物理连接数未达上限，创建新的物理连接，放入池中
-	p.Lock()
-	current = atomic.LoadInt32(&p.current)
-	if current < int32(p.opt.maxActive) && nextRef > current*int32(p.opt.maxConcurrentStreams) {
-		// 2 times the incremental or the remain incremental
-		increment := current
-		if current+increment > int32(p.opt.maxActive) {
-			increment = int32(p.opt.maxActive) - current
-		}
-		var i int32
-		var err error
-		for i = 0; i < increment; i++ {
-			c, er := p.opt.dial(p.address)
-			if er != nil {
-				err = er
-				break
-			}
-			p.delete(int(current + i))
-			p.conns[current+i] = p.wrapConn(c, false)
+	if err := p.grow(ctx); err != nil {
+		// 拨号速率超限时先使用负载最低的现有连接
+		if errors.Is(err, ErrDialRateLimited) && current > 0 {
+			return p.pickLeastLoaded(o)
+		}
+		p.decrRef()
+		return nil, err
+	}
+	return p.pickFree()
+}
+
+// tryPick borrows a physical connection by options.pick if it has room for one more borrower,
+// so that the Get needs neither the pool wide counters nor the growth. It returns nil otherwise.
+func (p *pool) tryPick(o *options) Conn {
+	if p.shards != nil {
+		// 按所在 P 选取分片
+		return p.tryPickSharded(o, int(procHint()%uint32(len(p.shards))))
+	}
+	borrowed, err := p.pick()
+	if err != nil {
+		return nil
+	}
+	c := borrowed.(*conn)
+	if o.needGrow(c.load(), int32(c.streams(o))) {
+		_ = c.unref()
+		if o.pick == RoundRobinPick {
+			// 未借出的连接不计入轮询，慢速路径从同一位置选取
+			p.index.add(-1)
+		}
+		return nil
+	}
+	return c
+}
+
+// getAsync 利用率达到阈值时后台扩容，调用者不等待拨号。
+func (p *pool) getAsync(ctx context.Context, o *options, demand, current, capacity int32) (Conn, error) {
+	if current < o.limit && o.needGrow(demand, capacity) {
+		p.growAsync()
+	}
+	if demand <= capacity {
+		return p.pick()
+	}
+	if current >= o.limit {
+		return p.overflow(ctx, o)
+	}
+	// 扩容尚未完成，先返回负载最低的现有连接
+	return p.pickLeastLoaded(o)
+}
+
+// overflow handles the Get exceeding the capacity when the pool is at the maxActive limit.
+func (p *pool) overflow(ctx context.Context, o *options) (Conn, error) {
+	// 阻塞模式，排队等待借出的连接归还
+	if o.block {
+		return p.wait(ctx, o)
+	}
+	atomic.AddUint64(&p.overflows, 1)
+	// 开启了连接复用，从池中拿一个物理连接
+	if o.reuse {
+		return p.pick()
+	}
+	// 未开启连接复用，创建一次性物理连接。
+	// 一次性连接数或拨号速率超限时拒绝拨号，退化为复用池中的连接。
+	if !p.reserveOneShot(o) {
+		atomic.AddUint64(&p.rejectedDials, 1)
+		return p.pick()
+	}
+	if p.limiter.take(o.dialRate, o.dialBurst, 1) == 0 {
+		p.releaseOneShot()
+		atomic.AddUint64(&p.rejectedDials, 1)
+		return p.pick()
+	}
+	c, err := p.dial(o, true)
+	if err != nil {
+		p.releaseOneShot()
+		p.decrRef()
+		return nil, err
+	}
+	return c, nil
+}
+
+// growAsync starts a growth round in the background unless one is already running.
+func (p *pool) growAsync() {
+	if !atomic.CompareAndSwapInt32(&p.asyncGrowing, 0, 1) {
+		return
+	}
+	go func() {
+		current := p.current()
+		// 失败时由后续的 Get 再次触发
+		err := p.grow(context.Background())
+		atomic.StoreInt32(&p.asyncGrowing, 0)
+		// 本轮扩容期间仍有等待者时继续为其交接或扩容
+		if err == nil && p.current() > current {
+			p.serveWaiters()
+		}
+	}()
+}
+
+// grow 合并并发的扩容请求：同一时刻只有一轮扩容，其余调用者等待其结果。
+// 扩容在后台进行，ctx 结束时调用者不再等待，扩容仍会完成。
+func (p *pool) grow(ctx context.Context) error {
+	p.growMu.Lock()
+	call := p.growing
+	if call == nil {
+		call = &growCall{done: make(chan struct{})}
+		p.growing = call
+		go func() {
+			call.err = p.doGrow()
+			p.growMu.Lock()
+			p.growing = nil
+			p.growMu.Unlock()
+			close(call.done)
+		}()
+	}
+	p.growMu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.err
+	case <-ctx.Done():
+		return getError(ctx)
+	}
+}
+
+// doGrow dials the increment concurrently without holding the pool lock,
+// then publishes the new connections at once.
+func (p *pool) doGrow() error {
+	if atomic.LoadInt32(&p.closed) == 1 {
+		return ErrClosed
+	}
+	o := p.options()
+	conns := p.snapshot()
+	current, capacity := int32(len(conns)), o.capacity(conns)
+	// 等待者也计入需求
+	if current >= o.limit || !o.needGrow(p.demand(p.ref.load()+atomic.LoadInt32(&p.queue.n)), capacity) {
+		// 上一轮扩容已满足需求
+		return nil
+	}
+	// 按 GrowthPolicy 计算增量，至少为 1，且不超过剩余的可扩容数。
+	increment := int32(o.growth.Increment(int(current), int(o.limit)))
+	if increment < 1 {
+		increment = 1
+	}
+	if current+increment > o.limit {
+		increment = o.limit - current
+	}
+	if n := int32(p.limiter.take(o.dialRate, o.dialBurst, int(increment))); n < increment {
+		atomic.AddUint64(&p.rejectedDials, uint64(increment-n))
+		if n == 0 {
+			return ErrDialRateLimited
 		}
-		current += i
-		//log.Printf("grow pool: %d ---> %d, increment: %d, maxActive: %d\n", p.current, current, increment, p.opt.maxActive)
-		atomic.StoreInt32(&p.current, current)
+		increment = n
+	}
+	cs, err := p.dialN(int(increment))
+	//log.Printf("grow pool: %d ---> %d, increment: %d, maxActive: %d\n", current, current+int32(len(cs)), increment, o.limit)
+	p.publish(cs)
+	if len(cs) == 0 {
+		return err
+	}
+	// 部分成功时已有可用的新连接，不向调用者报错。
+	return nil
+}
+
+// demand returns the logic connections needed when ref are borrowed.
+func (p *pool) demand(ref int32) int32 {
+	if inflight := p.inflight.load() + 1; inflight > ref {
+		return inflight
+	}
+	return ref
+}
+
+// capacity returns the logic connections the physical connections serve.
+func (o *options) capacity(conns []*conn) int32 {
+	if o.adaptiveStreams == 0 {
+		return int32(len(conns) * o.maxConcurrentStreams)
+	}
+	var capacity int32
+	for _, c := range conns {
+		capacity += int32(c.streams(o))
+	}
+	return capacity
+}
+
+// snapshot returns the physical connections in use, it must not be modified.
+func (p *pool) snapshot() []*conn {
+	return p.conns.Load().conns
+}
+
+// current returns the number of the physical connections in use.
+func (p *pool) current() int32 {
+	return int32(len(p.snapshot()))
+}
+
+// store replaces the physical connections in use with conns. p.Lock must be held.
+func (p *pool) store(conns []*conn) {
+	p.conns.Store(&connSet{conns: conns, shards: p.partition(conns)})
+}
+
+// put stores a copy of the connections in use with c at index i. p.Lock must be held.
+func (p *pool) put(i int32, c *conn) {
+	old := p.snapshot()
+	conns := make([]*conn, len(old), cap(old))
+	copy(conns, old)
+	conns[i] = c
+	p.store(conns)
+}
+
+// pick borrows a physical connection by options.pick.
+func (p *pool) pick() (Conn, error) {
+	o := p.options()
+	switch o.pick {
+	case LeastLoadedPick:
+		return p.pickLeastLoaded(o)
+	case FastestPick:
+		return p.pickFastest(o)
+	}
+	return p.pickRoundRobin(o)
+}
+
+// 轮询选取一个物理连接，并增加其引用计数。
+func (p *pool) pickRoundRobin(o *options) (Conn, error) {
+	now := o.now()
+	for conns := p.snapshot(); len(conns) > 0; conns = p.snapshot() {
+		if c := p.acquire(roundRobin(conns, &p.index, now)); c != nil {
+			return c, nil
+		}
+	}
+	return nil, ErrClosed
+}
+
+// 选取负载最低的物理连接。
+func (p *pool) pickLeastLoaded(o *options) (Conn, error) {
+	now := o.now()
+	for conns := p.snapshot(); len(conns) > 0; conns = p.snapshot() {
+		if c := p.acquire(leastLoaded(conns, now)); c != nil {
+			return c, nil
+		}
+	}
+	return nil, ErrClosed
+}
+
+// 选取时延与负载加权后较低的物理连接。
+func (p *pool) pickFastest(o *options) (Conn, error) {
+	now := o.now()
+	for conns := p.snapshot(); len(conns) > 0; conns = p.snapshot() {
+		if c := p.acquire(fastest(conns, now)); c != nil {
+			return c, nil
+		}
+	}
+	return nil, ErrClosed
+}
+
+// choose selects one of conns by options.pick without borrowing it, index is the round robin counter.
+func (o *options) choose(conns []*conn, index *paddedInt32, now int64) *conn {
+	switch o.pick {
+	case LeastLoadedPick:
+		return leastLoaded(conns, now)
+	case FastestPick:
+		return fastest(conns, now)
+	}
+	return roundRobin(conns, index, now)
+}
+
+// 轮询选取一个连接。跳过被驱逐的连接，全部被驱逐时仍使用轮询到的连接。conns 不能为空。
+func roundRobin(conns []*conn, index *paddedInt32, now int64) *conn {
+	next, n := uint32(index.add(1)), uint32(len(conns))
+	c := conns[next%n]
+	for i := uint32(1); i < n && c.ejected(now); i++ {
+		c = conns[(next+i)%n]
+	}
+	return c
+}
+
+// 选取负载最低的连接，优先选取未被驱逐的连接。conns 不能为空。
+func leastLoaded(conns []*conn, now int64) *conn {
+	var least *conn
+	for _, c := range conns {
+		if least == nil || (least.ejected(now) && !c.ejected(now)) ||
+			(least.ejected(now) == c.ejected(now) && c.load() < least.load()) {
+			least = c
+		}
+	}
+	return least
+}
+
+// 随机选取两个连接，返回时延与负载加权后较低的一个（power of two choices）。conns 不能为空。
+func fastest(conns []*conn, now int64) *conn {
+	a, b := conns[rand.Intn(len(conns))], conns[rand.Intn(len(conns))]
+	if cost(b, now) < cost(a, now) {
+		a = b
+	}
+	if a.ejected(now) {
+		// 两次都选中被驱逐的连接
+		return leastLoaded(conns, now)
+	}
+	return a
+}
+
+// cost is the expected latency of borrowing c, the unmeasured connections cost nothing to be probed.
+// the ejected connections cost the most.
+func cost(c *conn, now int64) int64 {
+	if c.ejected(now) {
+		return math.MaxInt64
+	}
+	return int64(c.latency()) * int64(c.load()+1)
+}
+
+// acquireFree borrows a connection having room for one more borrower, nil if there is none.
+func (p *pool) acquireFree(o *options) *conn {
+	now := o.now()
+	for _, c := range p.snapshot() {
+		if !c.ejected(now) && c.load() < int32(c.streams(o)) && p.acquire(c) != nil {
+			return c
+		}
+	}
+	return nil
+}
+
+// pickFree borrows a connection by options.pick, or another one having room for one more borrower
+// if the chosen one is saturated, e.g. the one the fast path of Get has found saturated.
+func (p *pool) pickFree() (Conn, error) {
+	borrowed, err := p.pick()
+	if err != nil {
+		return nil, err
+	}
+	o := p.options()
+	c := borrowed.(*conn)
+	if c.load() <= int32(c.streams(o)) {
+		return c, nil
+	}
+	// 选中的连接已占满，改为借出有余量的连接，例如刚扩容的连接
+	if free := p.acquireFree(o); free != nil {
+		_ = c.unref()
+		return free, nil
+	}
+	return c, nil
+}
+
+// acquire increases the reference of c, returns nil if c is retired.
+func (p *pool) acquire(c *conn) *conn {
+	atomic.AddInt32(&c.ref, 1)
+	if atomic.LoadInt32(&c.retired) == 1 {
+		// 连接已被替换或关闭，新的快照中已不含该连接，释放后重新选取。
+		_ = c.unref()
+		return nil
+	}
+	return c
+}
+
+func (p *pool) Redial() error {
+	p.redialMu.Lock()
+	defer p.redialMu.Unlock()
+
+	for i := int32(0); ; i++ {
+		if atomic.LoadInt32(&p.closed) == 1 {
+			return ErrClosed
+		}
+		if i >= p.current() {
+			return nil
+		}
+		c, err := p.dial(p.options(), false)
 		if err != nil {
+			return err
+		}
+
+		p.Lock()
+		old := p.at(i)
+		if old == nil || atomic.LoadInt32(&p.closed) == 1 {
+			// 重新拨号期间连接池已缩容或关闭
 			p.Unlock()
-			return nil, err
+			_ = c.reset()
+			continue
 		}
+		p.put(i, c)
+		p.Unlock()
+		old.retire()
+		p.serveWaiters()
+	}
+}
+
+// redialAsync re-dials the pool in the background for a notification, so the notifier doesn't
+// wait for the dials. The notifications during a re-dial are served by one more round.
+// The errors are reported to options.onError.
+func (p *pool) redialAsync() {
+	if atomic.AddInt32(&p.redialRequests, 1) > 1 {
+		return
+	}
+	go func() {
+		for {
+			requests := atomic.LoadInt32(&p.redialRequests)
+			if err := p.Redial(); err != nil && !errors.Is(err, ErrClosed) {
+				atomic.AddUint64(&p.redialErrors, 1)
+				if o := p.options(); o.onError != nil {
+					o.onError(err)
+				}
+			}
+			// 重新拨号期间又收到通知，再滚动重建一轮
+			if atomic.AddInt32(&p.redialRequests, -requests) == 0 {
+				return
+			}
+		}
+	}()
+}
+
+func (p *pool) Reconfigure(opts ...Option) error {
+	// 新的上限下为等待者借出或扩容，在释放锁后进行
+	defer p.serveWaiters()
+	p.Lock()
+	defer p.Unlock()
+	if atomic.LoadInt32(&p.closed) == 1 {
+		return ErrClosed
+	}
+
+	old := p.options()
+	o := *old
+	for _, opt := range opts {
+		opt(&o)
+	}
+	// 通知源仅在 New 时订阅
+	o.notifiers = old.notifiers
+	if err := o.init(); err != nil {
+		return err
+	}
+	if o.shards != old.shards {
+		return configError("shards", "can't be changed at runtime")
+	}
+	p.opt.Store(&o)
+	p.resize(&o)
+
+	// 无引用且超过了新的最大空闲连接数，立即缩容。
+	if p.ref.load() == 0 && p.current() > int32(o.maxIdle) {
+		p.shrink()
+	}
+	return nil
+}
+
+// resize retires the connections beyond the limit of o and reallocates the connection storage.
+// p.Lock must be held.
+func (p *pool) resize(o *options) {
+	limit := int(o.limit)
+	conns := p.snapshot()
+	var retired []*conn
+	if len(conns) > limit {
+		conns, retired = conns[:limit], conns[limit:]
+	}
+
+	size := o.maxActive
+	if size == 0 {
+		// 不限制时保留已扩展的容量，但不超过新的安全上限。
+		size = cap(conns)
+		if size > limit {
+			size = limit
+		}
+		if size < o.maxIdle {
+			size = o.maxIdle
+		}
+	}
+	if size == cap(conns) && retired == nil {
+		return
+	}
+	next := make([]*conn, len(conns), size)
+	copy(next, conns)
+	p.store(next)
+	// 超出新上限的连接退役，借出的连接在归还后关闭。
+	for _, c := range retired {
+		c.retire()
 	}
-	p.Unlock()
-	next := atomic.AddUint32(&p.index, 1) % uint32(current)
-	return p.conns[next], nil
 }
 
 func (p *pool) Close() {
-	atomic.StoreInt32(&p.closed, 1)
-	atomic.StoreUint32(&p.index, 0)
-	atomic.StoreInt32(&p.current, 0)
-	atomic.StoreInt32(&p.ref, 0)
-	p.deleteFrom(0)
+	if !atomic.CompareAndSwapInt32(&p.closed, 0, 1) {
+		return
+	}
+	for _, unsubscribe := range p.unsubscribes {
+		unsubscribe()
+	}
+	close(p.done)
+	p.queue.close()
+	p.Lock()
+	p.index.store(0)
+	p.ref.reset()
+	conns := p.snapshot()
+	p.store(nil)
+	p.Unlock()
+	// 借出的连接也立即关闭，退役保证它们不会再被借出。
+	for _, c := range conns {
+		c.retire()
+		_ = c.release()
+	}
 	//log.Printf("close pool success: %v\n", p.Status())
 }
 
 func (p *pool) Status() string {
 	return fmt.Sprintf("ptr: %p, address:%s, closed:%d, index:%d, current:%d, ref:%d. option:%v",
-		p, p.address, p.closed, p.index, p.current, p.ref, p.opt)
+		p, p.address, atomic.LoadInt32(&p.closed), p.index.load(), p.current(), p.ref.load(), p.options())
 }
 
-func (p *pool) wrapConn(cc *grpc.ClientConn, once bool) *conn {
-	return &conn{
-		cc:   cc,
-		pool: p,
-		once: once,
+// dialN dials n connections, at most options.dialConcurrency in parallel.
+// It returns the successful connections and the first error.
+func (p *pool) dialN(n int) ([]*conn, error) {
+	o := p.options()
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		cs       = make([]*conn, 0, n)
+		firstErr error
+		sem      = make(chan struct{}, o.dialConcurrency)
+	)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			c, err := p.dial(o, false)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+			cs = append(cs, c)
+		}()
 	}
+	wg.Wait()
+	return cs, firstErr
 }
 
-// 原子操作，引用计数（逻辑连接数）加一。
-func (p *pool) incrRef() int32 {
-	newRef := atomic.AddInt32(&p.ref, 1)
-	if newRef == math.MaxInt32 {
-		panic(fmt.Sprintf("overflow ref: %d", newRef))
+// publish appends the connections to the pool, closes the ones exceeding the limit.
+func (p *pool) publish(cs []*conn) {
+	if len(cs) == 0 {
+		return
+	}
+	// 新连接发布后交接给等待者
+	defer p.serveWaiters()
+	p.Lock()
+	defer p.Unlock()
+	old := p.snapshot()
+	n := int(p.options().limit) - len(old)
+	if atomic.LoadInt32(&p.closed) == 1 || n < 0 {
+		n = 0
+	}
+	if n > len(cs) {
+		n = len(cs)
+	}
+	for _, c := range cs[n:] {
+		_ = c.reset()
+	}
+	if n == 0 {
+		return
+	}
+	conns := make([]*conn, len(old), p.storage(len(old)+n))
+	copy(conns, old)
+	p.store(append(conns, cs[:n]...))
+}
+
+// storage returns the storage to hold n connections, it doubles the current storage
+// of the unlimited pool, at most to the limit.
+func (p *pool) storage(n int) int {
+	size, limit := cap(p.snapshot()), int(p.options().limit)
+	if size == 0 {
+		size = 1
+	}
+	for size < n && size < limit {
+		size *= 2
+	}
+	if size > limit {
+		size = limit
+	}
+	return size
+}
+
+// 后台补齐物理连接至 target 个，失败后按指数退避重试，直到补齐或连接池关闭。
+func (p *pool) fill(target int) {
+	backoff := p.options().fillBackoff
+	for {
+		timer := time.NewTimer(backoff)
+		select {
+		case <-p.done:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		missing := target - int(p.current())
+		if missing <= 0 {
+			return
+		}
+		cs, err := p.dialN(missing)
+		p.publish(cs)
+		if err == nil {
+			return
+		}
+		if backoff *= 2; backoff > p.options().fillMaxBackoff {
+			backoff = p.options().fillMaxBackoff
+		}
+	}
+}
+
+// maintain periodically replaces the shutdown connections, ejects the outliers,
+// keeps at least minIdle connections and shrinks the idle pool.
+func (p *pool) maintain() {
+	for {
+		// 每个周期重新读取 maintainInterval，Reconfigure 可修改它。
+		timer := time.NewTimer(p.options().maintainInterval)
+		select {
+		case <-p.done:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		p.replaceShutdown()
+		p.detectOutliers()
+		// 低于 minIdle 时补齐，失败则等待下个周期重试
+		if missing := p.options().minIdle - int(p.current()); missing > 0 {
+			cs, _ := p.dialN(missing)
+			p.publish(cs)
+		}
+		// 归还时因在途 RPC 未能缩容的连接，在此重试
+		if p.current() > int32(p.options().maxIdle) && p.ref.load() == 0 {
+			p.Lock()
+			if p.ref.load() == 0 && atomic.LoadInt32(&p.closed) == 0 {
+				p.shrink()
+			}
+			p.Unlock()
+		}
+	}
+}
+
+// replaceShutdown replaces the connections closed by the application, e.g. conn.Value().Close().
+func (p *pool) replaceShutdown() {
+	for i, c := range p.snapshot() {
+		if c.cc.GetState() != connectivity.Shutdown {
+			continue
+		}
+		if p.replace(int32(i), c) != nil {
+			return
+		}
+	}
+}
+
+// replace dials a connection to replace old at index i, old is retired.
+// It does nothing if the connection at i is no longer old.
+func (p *pool) replace(i int32, old *conn) error {
+	c, err := p.dial(p.options(), false)
+	if err != nil {
+		return err
+	}
+	p.Lock()
+	if p.at(i) != old || atomic.LoadInt32(&p.closed) == 1 {
+		p.Unlock()
+		_ = c.reset()
+		return nil
+	}
+	p.put(i, c)
+	p.Unlock()
+	old.retire()
+	p.serveWaiters()
+	return nil
+}
+
+// at returns the connection at index i, nil if i is beyond current.
+func (p *pool) at(i int32) *conn {
+	if conns := p.snapshot(); int(i) < len(conns) {
+		return conns[i]
+	}
+	return nil
+}
+
+func (p *pool) Stats() Stats {
+	o := p.options()
+	set := p.conns.Load()
+	conns := set.conns
+	return Stats{
+		Address:       p.address,
+		Closed:        atomic.LoadInt32(&p.closed) == 1,
+		Current:       len(conns),
+		Ref:           int(p.ref.load()),
+		InFlight:      int(p.inflight.load()),
+		Capacity:      int(o.capacity(conns)),
+		MaxActive:     o.maxActive,
+		Limit:         int(o.limit),
+		Storage:       cap(conns),
+		Overflows:     atomic.LoadUint64(&p.overflows),
+		Ejections:     atomic.LoadUint64(&p.ejections),
+		CircuitOpen:   p.breaker.open(),
+		OneShots:      int(atomic.LoadInt32(&p.oneShots)),
+		RejectedDials: atomic.LoadUint64(&p.rejectedDials),
+		RefErrors:     atomic.LoadUint64(&p.refErrors),
+		RedialErrors:  atomic.LoadUint64(&p.redialErrors),
+		Waiting:       int(atomic.LoadInt32(&p.queue.n)),
+		Waits:         atomic.LoadUint64(&p.waits),
+		WaitTime:      time.Duration(atomic.LoadInt64(&p.waitTime)),
+		Shed:          atomic.LoadUint64(&p.shed),
+		Conns:         connStats(o, conns),
+		Shards:        p.shardStats(set),
+	}
+}
+
+// options returns the options in effect.
+func (p *pool) options() *options {
+	return p.opt.Load().(*options)
+}
+
+// dial dials a physical connection through the circuit breaker. The pooled connections
+// dialed from a DialConfig are observed by a tracker, see AdaptiveStreams.
+func (p *pool) dial(o *options, once bool) (*conn, error) {
+	var (
+		t    *tracker
+		opts []grpc.DialOption
+	)
+	if o.dialConfig != nil && !once {
+		t = newTracker(p, o.maxConcurrentStreams)
+		opts = append(opts, grpc.WithStatsHandler(t))
+	}
+	if err := p.breaker.allow(o); err != nil {
+		return nil, err
+	}
+	cc, err := o.dialer(p.address, opts...)
+	p.breaker.done(o, err)
+	if err != nil {
+		attempt := atomic.AddInt32(&p.dialFailures, 1)
+		return nil, &DialError{Address: p.address, Attempt: int(attempt), Err: err}
+	}
+	atomic.StoreInt32(&p.dialFailures, 0)
+	return &conn{
+		cc:        cc,
+		pool:      p,
+		once:      once,
+		tracker:   t,
+		createdAt: time.Now(),
+	}, nil
+}
+
+// 原子操作，引用计数（逻辑连接数）加一。各分片的总和溢出时不再计数并报告错误。
+func (p *pool) incrRef() {
+	if !p.ref.incr(procHint(), math.MaxInt32) {
+		p.report(fmt.Errorf("%w: ref %d", ErrRefOverflow, p.ref.sum()))
 	}
-	return newRef
 }
 
 // 原子操作，引用计数（逻辑连接数）减一。
 func (p *pool) decrRef() {
-	newRef := atomic.AddInt32(&p.ref, -1)
-	if newRef < 0 && atomic.LoadInt32(&p.closed) == 0 {
-		panic(fmt.Sprintf("negative ref: %d", newRef))
-	}
-	// 无引用，当前物理连接数均为空闲连接，且超过了最大空闲连接数
-	// 连接池缩容，将物理连接数减少至最大空闲连接数。
-	if newRef == 0 && atomic.LoadInt32(&p.current) > int32(p.opt.maxIdle) {
+	p.ref.add(procHint(), -1)
+	// 超过了最大空闲连接数，且无引用，当前物理连接数均为空闲连接，
+	// 连接池缩容，按 ShrinkPolicy 关闭多余的物理连接。仅在此时汇总引用计数。
+	if p.current() > int32(p.options().maxIdle) && p.ref.load() == 0 {
 		p.Lock()
-		if atomic.LoadInt32(&p.ref) == 0 {
-			//log.Printf("shrink pool: %d ---> %d, decrement: %d, maxActive: %d\n", p.current, p.opt.maxIdle, p.current-int32(p.opt.maxIdle), p.opt.maxActive)
-			atomic.StoreInt32(&p.current, int32(p.opt.maxIdle))
-			p.deleteFrom(p.opt.maxIdle)
+		if p.ref.load() == 0 && atomic.LoadInt32(&p.closed) == 0 {
+			p.shrink()
 		}
 		p.Unlock()
 	}
 }
 
-func (p *pool) deleteFrom(begin int) {
-	for i := begin; i < p.opt.maxActive; i++ {
-		p.delete(i)
+// report counts a misuse of the pool and calls options.onError, it panics in the strict mode.
+func (p *pool) report(err error) {
+	atomic.AddUint64(&p.refErrors, 1)
+	o := p.options()
+	if o.onError != nil {
+		o.onError(err)
+	}
+	if o.strict {
+		panic(err)
 	}
 }
 
-func (p *pool) delete(index int) {
-	conn := p.conns[index]
-	if conn == nil {
+// shrink retires the connections the ShrinkPolicy evicts, at most down to maxIdle.
+// the remaining connections keep their order and move forward. p.Lock must be held.
+func (p *pool) shrink() {
+	o := p.options()
+	conns := p.snapshot()
+	current := len(conns)
+	if current <= o.maxIdle {
+		// 检查后到加锁前并发的 Reconfigure 可能调高了 maxIdle
+		return
+	}
+	evict := make(map[int]bool)
+	for _, i := range o.shrink.Evict(connStats(o, conns), o.maxIdle) {
+		// 仍有在途 RPC 的连接不关闭，例如归还后仍在使用的流
+		if i >= 0 && i < current && len(evict) < current-o.maxIdle && !conns[i].busy() {
+			evict[i] = true
+		}
+	}
+	if len(evict) == 0 {
 		return
 	}
-	_ = conn.reset()
-	p.conns[index] = nil
+
+	kept := make([]*conn, 0, cap(conns))
+	for i, c := range conns {
+		if !evict[i] {
+			kept = append(kept, c)
+		}
+	}
+	//log.Printf("shrink pool: %d ---> %d, decrement: %d, maxActive: %d\n", current, len(kept), current-len(kept), o.limit)
+	p.store(kept)
+	// 并发的 Get 可能仍持有旧快照，退役保证被借出的连接在归还后才关闭。
+	for i := range evict {
+		conns[i].retire()
+	}
+}
+
+// connStats returns the stats of the connections.
+func connStats(o *options, conns []*conn) []ConnStat {
+	stats := make([]ConnStat, len(conns))
+	for i, c := range conns {
+		stats[i] = c.stat(i, o)
+	}
+	return stats
 }
@@ -18,7 +18,9 @@ package grpcpool
 
 import (
 	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"github.com/chengyayu/grpcpool/example/single/pb"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc"
@@ -26,6 +28,7 @@ import (
 	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/keepalive"
 	"log"
+	"math"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -130,11 +133,11 @@ func TestNew(t *testing.T) {
 	require.NoError(t, err)
 	defer p.Close()
 
-	options := nativePool.opt
-	require.EqualValues(t, 0, nativePool.index)
-	require.EqualValues(t, 0, nativePool.ref)
-	require.EqualValues(t, options.maxIdle, nativePool.current)
-	require.EqualValues(t, options.maxActive, len(nativePool.conns))
+	options := nativePool.options()
+	require.EqualValues(t, 0, nativePool.index.load())
+	require.EqualValues(t, 0, nativePool.ref.load())
+	require.EqualValues(t, options.maxIdle, nativePool.current())
+	require.EqualValues(t, options.maxActive, cap(nativePool.snapshot()))
 }
 
 func TestNew2(t *testing.T) {
@@ -150,35 +153,236 @@ func TestNew2(t *testing.T) {
 	_, err = New("127.0.0.1:8080", MaxIdle(0))
 	require.Error(t, err)
 
-	_, err = New("127.0.0.1:8080", MaxActive(0))
+	_, err = New("127.0.0.1:8080", MaxActive(-1))
+	require.Error(t, err)
+
+	_, err = New("127.0.0.1:8080", MaxActive(0), UnlimitedCap(4))
 	require.Error(t, err)
 
 	_, err = New("127.0.0.1:8080", MaxIdle(2), MaxActive(1))
 	require.Error(t, err)
 }
 
+func TestPartialStart(t *testing.T) {
+	var (
+		mu                         sync.Mutex
+		calls, dialing, maxDialing int
+	)
+	dial := func(address string) (*grpc.ClientConn, error) {
+		mu.Lock()
+		calls++
+		n := calls
+		if dialing++; dialing > maxDialing {
+			maxDialing = dialing
+		}
+		mu.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		dialing--
+		mu.Unlock()
+		if n == 2 || n == 3 {
+			return nil, errors.New("dial failed")
+		}
+		return DialTest(address)
+	}
+
+	p, err := New(*endpoint, Dial(dial), MaxIdle(4), MaxActive(8), MinStart(2),
+		DialConcurrency(2), FillBackoff(10*time.Millisecond, 20*time.Millisecond))
+	require.NoError(t, err)
+	defer p.Close()
+	nativePool := p.(*pool)
+
+	require.EqualValues(t, 2, nativePool.current())
+	require.Eventually(t, func() bool {
+		return nativePool.current() == 4
+	}, 5*time.Second, 10*time.Millisecond)
+	mu.Lock()
+	require.EqualValues(t, 2, maxDialing)
+	mu.Unlock()
+
+	failed := Dial(func(address string) (*grpc.ClientConn, error) {
+		return nil, errors.New("dial failed")
+	})
+	_, err = New(*endpoint, failed, MaxIdle(2), MinStart(1))
+	require.Error(t, err)
+
+	_, err = New(*endpoint, MaxIdle(2), MinStart(3))
+	require.Error(t, err)
+
+	_, err = New(*endpoint, DialConcurrency(0))
+	require.Error(t, err)
+}
+
+func TestUnlimited(t *testing.T) {
+	p, nativePool, err := newPool(MaxIdle(1), MaxActive(0), UnlimitedCap(5), MaxConcurrentStreams(1))
+	require.NoError(t, err)
+	defer p.Close()
+	require.EqualValues(t, 1, cap(nativePool.snapshot()))
+
+	for i := 0; i < 6; i++ {
+		conn, err := p.Get()
+		require.NoError(t, err)
+		defer conn.Close()
+	}
+
+	stats := p.Stats()
+	require.EqualValues(t, 5, stats.Current)
+	require.EqualValues(t, 6, stats.Ref)
+	require.EqualValues(t, 0, stats.MaxActive)
+	require.EqualValues(t, 5, stats.Limit)
+	require.EqualValues(t, 5, stats.Storage)
+	require.EqualValues(t, 1, stats.Overflows)
+	require.Len(t, stats.Conns, 5)
+}
+
+func TestLazy(t *testing.T) {
+	var dials int32
+	dial := Dial(func(address string) (*grpc.ClientConn, error) {
+		atomic.AddInt32(&dials, 1)
+		return DialTest(address)
+	})
+
+	_, err := New(*endpoint, MaxIdle(2), MinIdle(3))
+	require.Error(t, err)
+
+	p, err := New(*endpoint, dial, MaxIdle(2), Lazy(true))
+	require.NoError(t, err)
+	defer p.Close()
+	nativePool := p.(*pool)
+	require.EqualValues(t, 0, atomic.LoadInt32(&dials))
+
+	conn, err := p.Get()
+	require.NoError(t, err)
+	require.EqualValues(t, 1, atomic.LoadInt32(&dials))
+	require.EqualValues(t, 1, nativePool.current())
+	conn.Close()
+
+	p2, err := New(*endpoint, dial, MaxIdle(4), MinIdle(2), Lazy(true), FillBackoff(time.Millisecond, time.Millisecond))
+	require.NoError(t, err)
+	defer p2.Close()
+	require.Eventually(t, func() bool {
+		return p2.(*pool).current() == 2
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestMinIdle(t *testing.T) {
+	p, nativePool, err := newPool(MaxIdle(2), MinIdle(2), MaintainInterval(10*time.Millisecond))
+	require.NoError(t, err)
+	defer p.Close()
+
+	// the shutdown connection is replaced by the maintenance.
+	broken := nativePool.snapshot()[0]
+	require.NoError(t, broken.Value().Close())
+	require.Eventually(t, func() bool {
+		return nativePool.snapshot()[0] != broken
+	}, 5*time.Second, 10*time.Millisecond)
+	require.EqualValues(t, 2, nativePool.current())
+}
+
+func TestReconfigure(t *testing.T) {
+	p, nativePool, err := newPool(MaxIdle(2), MaxActive(4), MaxConcurrentStreams(1))
+	require.NoError(t, err)
+	defer p.Close()
+
+	conns := make([]Conn, 4)
+	for i := range conns {
+		conns[i], err = p.Get()
+		require.NoError(t, err)
+	}
+	require.EqualValues(t, 4, nativePool.current())
+	retired := []*conn{nativePool.snapshot()[2], nativePool.snapshot()[3]}
+
+	// invalid updates keep the old options.
+	require.Error(t, p.Reconfigure(MaxIdle(3), MaxActive(2)))
+	require.Error(t, p.Reconfigure(MaxConcurrentStreams(0)))
+	require.EqualValues(t, 4, nativePool.options().maxActive)
+	require.EqualValues(t, 1, nativePool.options().maxConcurrentStreams)
+
+	// the connections beyond the new limit are retired, but the borrowed ones keep working.
+	require.NoError(t, p.Reconfigure(MaxIdle(1), MaxActive(2), Reuse(false)))
+	require.EqualValues(t, 2, nativePool.current())
+	require.Equal(t, 2, cap(nativePool.snapshot()))
+	require.EqualValues(t, 2, p.Stats().Limit)
+	for _, c := range retired {
+		borrowed := atomic.LoadInt32(&c.ref) > 0
+		require.Equal(t, borrowed, c.cc.GetState() != connectivity.Shutdown)
+	}
+
+	// the pool is at the new limit, Get returns a one-time connection.
+	once, err := p.Get()
+	require.NoError(t, err)
+	require.True(t, once.(*conn).once)
+	require.NoError(t, once.Close())
+
+	for _, c := range conns {
+		require.NoError(t, c.Close())
+	}
+	for _, c := range retired {
+		require.Equal(t, connectivity.Shutdown, c.cc.GetState())
+	}
+	// idle, shrinks to the new maxIdle.
+	require.EqualValues(t, 1, nativePool.current())
+
+	require.NoError(t, p.Reconfigure(MaxActive(8)))
+	require.Equal(t, 8, cap(nativePool.snapshot()))
+
+	p.Close()
+	require.ErrorIs(t, p.Reconfigure(MaxIdle(1)), ErrClosed)
+}
+
 func TestClose(t *testing.T) {
 	p, nativePool, err := newPool()
 	require.NoError(t, err)
 	p.Close()
 
-	options := nativePool.opt
-	require.EqualValues(t, 0, nativePool.index)
-	require.EqualValues(t, 0, nativePool.ref)
-	require.EqualValues(t, 0, nativePool.current)
-	require.EqualValues(t, true, nativePool.conns[0] == nil)
-	require.EqualValues(t, true, nativePool.conns[options.maxIdle-1] == nil)
+	require.EqualValues(t, 0, nativePool.index.load())
+	require.EqualValues(t, 0, nativePool.ref.load())
+	require.EqualValues(t, 0, nativePool.current())
+	require.Empty(t, nativePool.snapshot())
 }
 
 func TestReset(t *testing.T) {
 	p, nativePool, err := newPool()
 	require.NoError(t, err)
-	defer p.Close()
 
-	nativePool.delete(0)
-	require.EqualValues(t, true, nativePool.conns[0] == nil)
-	nativePool.delete(nativePool.opt.maxIdle + 1)
-	require.EqualValues(t, true, nativePool.conns[nativePool.opt.maxIdle+1] == nil)
+	// a connection borrowed before Close keeps its value but is closed.
+	borrowed, err := p.Get()
+	require.NoError(t, err)
+	idle := nativePool.snapshot()[1]
+	p.Close()
+	require.NotNil(t, borrowed.Value())
+	require.Equal(t, connectivity.Shutdown, borrowed.Value().GetState())
+	require.Equal(t, connectivity.Shutdown, idle.cc.GetState())
+	require.NoError(t, borrowed.Close())
+}
+
+func TestCloseConcurrent(t *testing.T) {
+	p, _, err := newPool(MaxIdle(2), MaxActive(4), MaxConcurrentStreams(1))
+	require.NoError(t, err)
+
+	// Close is safe with the concurrent Gets, they fail with ErrClosed after it.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				borrowed, err := p.Get()
+				if err != nil {
+					require.ErrorIs(t, err, ErrClosed)
+					continue
+				}
+				require.NotNil(t, borrowed.Value())
+				require.NoError(t, borrowed.Close())
+			}
+		}()
+	}
+	time.Sleep(time.Millisecond)
+	p.Close()
+	wg.Wait()
+	_, err = p.Get()
+	require.ErrorIs(t, err, ErrClosed)
 }
 
 func TestBasicGet(t *testing.T) {
@@ -190,13 +394,13 @@ func TestBasicGet(t *testing.T) {
 	require.NoError(t, err)
 	require.EqualValues(t, true, conn.Value() != nil)
 
-	require.EqualValues(t, 1, nativePool.index)
-	require.EqualValues(t, 1, nativePool.ref)
+	require.EqualValues(t, 1, nativePool.index.load())
+	require.EqualValues(t, 1, nativePool.ref.load())
 
 	conn.Close()
 
-	require.EqualValues(t, 1, nativePool.index)
-	require.EqualValues(t, 0, nativePool.ref)
+	require.EqualValues(t, 1, nativePool.index.load())
+	require.EqualValues(t, 0, nativePool.ref.load())
 }
 
 func TestAfterCloseGRPCChannel(t *testing.T) {
@@ -246,18 +450,18 @@ func TestBasicGet2(t *testing.T) {
 	require.NoError(t, err)
 	defer conn2.Close()
 
-	require.EqualValues(t, 2, nativePool.index)
-	require.EqualValues(t, 2, nativePool.ref)
-	require.EqualValues(t, 1, nativePool.current)
+	require.EqualValues(t, 2, nativePool.index.load())
+	require.EqualValues(t, 2, nativePool.ref.load())
+	require.EqualValues(t, 1, nativePool.current())
 
 	// create new connections push back to pool
 	conn3, err := p.Get()
 	require.NoError(t, err)
 	defer conn3.Close()
 
-	require.EqualValues(t, 3, nativePool.index)
-	require.EqualValues(t, 3, nativePool.ref)
-	require.EqualValues(t, 2, nativePool.current)
+	require.EqualValues(t, 3, nativePool.index.load())
+	require.EqualValues(t, 3, nativePool.ref.load())
+	require.EqualValues(t, 2, nativePool.current())
 
 	conn4, err := p.Get()
 	require.NoError(t, err)
@@ -272,6 +476,24 @@ func TestBasicGet2(t *testing.T) {
 	require.EqualValues(t, false, nativeConn.once)
 }
 
+func TestGrowAfterFastPath(t *testing.T) {
+	p, _, err := newPool(MaxIdle(1), MaxActive(8), MaxConcurrentStreams(1))
+	require.NoError(t, err)
+	defer p.Close()
+
+	// the Gets the fast path rejects grow the pool, no connection carries more than its streams.
+	for i := 0; i < 3; i++ {
+		_, err := p.Get()
+		require.NoError(t, err)
+	}
+	stats := p.Stats()
+	require.Equal(t, 4, stats.Current)
+	require.Equal(t, 3, stats.Ref)
+	for _, c := range stats.Conns {
+		require.LessOrEqual(t, c.Ref, 1)
+	}
+}
+
 func TestBasicGet3(t *testing.T) {
 	opts := []Option{
 		Dial(DialTest),
@@ -298,6 +520,92 @@ func TestBasicGet3(t *testing.T) {
 	require.EqualValues(t, true, nativeConn.once)
 }
 
+func TestSingleflightGrow(t *testing.T) {
+	var dials int32
+	dial := func(address string) (*grpc.ClientConn, error) {
+		atomic.AddInt32(&dials, 1)
+		time.Sleep(200 * time.Millisecond)
+		return DialTest(address)
+	}
+
+	p, err := New(*endpoint, Dial(dial), MaxIdle(1), MaxActive(8), MaxConcurrentStreams(1))
+	require.NoError(t, err)
+	defer p.Close()
+	nativePool := p.(*pool)
+
+	conn, err := p.Get()
+	require.NoError(t, err)
+	defer conn.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(5)
+	for i := 0; i < 5; i++ {
+		go func() {
+			defer wg.Done()
+			c, err := p.Get()
+			require.NoError(t, err)
+			c.Close()
+		}()
+	}
+
+	// the pool lock isn't held while dialing.
+	time.Sleep(50 * time.Millisecond)
+	locked := make(chan struct{})
+	go func() {
+		nativePool.Lock()
+		nativePool.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("pool lock is held while dialing")
+	}
+
+	wg.Wait()
+	// one dial for the initial fill, one growth round for the burst.
+	require.EqualValues(t, 2, atomic.LoadInt32(&dials))
+	require.EqualValues(t, 2, nativePool.current())
+}
+
+func TestAsyncGrowth(t *testing.T) {
+	var dials int32
+	dial := func(address string) (*grpc.ClientConn, error) {
+		if atomic.AddInt32(&dials, 1) > 1 {
+			time.Sleep(200 * time.Millisecond)
+		}
+		return DialTest(address)
+	}
+
+	_, err := New(*endpoint, AsyncGrowth(1.5))
+	require.Error(t, err)
+
+	p, err := New(*endpoint, Dial(dial), MaxIdle(1), MaxActive(4), MaxConcurrentStreams(2), AsyncGrowth(0.5))
+	require.NoError(t, err)
+	defer p.Close()
+	nativePool := p.(*pool)
+
+	// the Gets reaching the threshold or exceeding the capacity don't wait for the dials.
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		conn, err := p.Get()
+		require.NoError(t, err)
+		defer conn.Close()
+	}
+	require.Less(t, time.Since(start), 100*time.Millisecond)
+	require.EqualValues(t, 1, nativePool.current())
+
+	require.Eventually(t, func() bool {
+		return nativePool.current() == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the new connection takes the traffic.
+	conn, err := p.Get()
+	require.NoError(t, err)
+	defer conn.Close()
+	require.EqualValues(t, true, conn == nativePool.snapshot()[1])
+}
+
 func TestConcurrentGet(t *testing.T) {
 	opts := []Option{
 		Dial(DialTest),
@@ -322,17 +630,16 @@ func TestConcurrentGet(t *testing.T) {
 			conn.Close()
 			wg.Done()
 			t.Logf("goroutine: %v, index: %v, ref: %v, current: %v", i,
-				atomic.LoadUint32(&nativePool.index),
-				atomic.LoadInt32(&nativePool.ref),
-				atomic.LoadInt32(&nativePool.current))
+				nativePool.index.load(),
+				nativePool.ref.load(),
+				nativePool.current())
 		}(i)
 	}
 	wg.Wait()
 
-	require.EqualValues(t, 0, nativePool.ref)
-	require.EqualValues(t, nativePool.opt.maxIdle, nativePool.current)
-	require.EqualValues(t, true, nativePool.conns[0] != nil)
-	require.EqualValues(t, true, nativePool.conns[nativePool.opt.maxIdle] == nil)
+	require.EqualValues(t, 0, nativePool.ref.load())
+	require.EqualValues(t, nativePool.options().maxIdle, nativePool.current())
+	require.Len(t, nativePool.snapshot(), nativePool.options().maxIdle)
 }
 
 var size = 4 * 1024 * 1024
@@ -423,3 +730,166 @@ func BenchmarkOnlyOneRPC(b *testing.B) {
 		}
 	})
 }
+
+func TestRefMisuse(t *testing.T) {
+	var reported []error
+	p, nativePool, err := newPool(MaxIdle(1), OnError(func(err error) { reported = append(reported, err) }))
+	require.NoError(t, err)
+	defer p.Close()
+
+	// closing a connection twice is reported and the reference counts stay at zero.
+	borrowed, err := p.Get()
+	require.NoError(t, err)
+	require.NoError(t, borrowed.Close())
+	require.NoError(t, borrowed.Close())
+	require.Len(t, reported, 1)
+	require.ErrorIs(t, reported[0], ErrNegativeRef)
+	require.EqualValues(t, 1, p.Stats().RefErrors)
+	require.Zero(t, p.Stats().Ref)
+	require.Zero(t, p.Stats().Conns[0].Ref)
+
+	// the pool still works after the misuse.
+	borrowed, err = p.Get()
+	require.NoError(t, err)
+	require.EqualValues(t, 1, p.Stats().Ref)
+	require.NoError(t, borrowed.Close())
+
+	// the overflowing reference is not counted, wherever the references are.
+	// the stripes reached the limit by incr, so the sum is checked.
+	stripes := nativePool.ref.stripes
+	stripes[len(stripes)-1].store(math.MaxInt32 - 1)
+	atomic.StoreInt32(&nativePool.ref.hot, 1)
+	nativePool.incrRef()
+	require.Len(t, reported, 2)
+	require.ErrorIs(t, reported[1], ErrRefOverflow)
+	require.EqualValues(t, math.MaxInt32-1, nativePool.ref.sum())
+	nativePool.ref.reset()
+	require.EqualValues(t, 2, p.Stats().RefErrors)
+
+	// closing the pool first is not a misuse.
+	borrowed, err = p.Get()
+	require.NoError(t, err)
+	p.Close()
+	require.NoError(t, borrowed.Close())
+	require.Len(t, reported, 2)
+}
+
+func TestRetireReborrowed(t *testing.T) {
+	p, nativePool, err := newPool(MaxIdle(1), MaxActive(1))
+	require.NoError(t, err)
+	defer p.Close()
+
+	borrowed, err := p.Get()
+	require.NoError(t, err)
+	c := borrowed.(*conn)
+
+	// the borrower releases the last reference, a Get on the old snapshot borrows the connection
+	// before the release checks retired, and Redial retires it in between.
+	ref := atomic.AddInt32(&c.ref, -1)
+	nativePool.releaseRef(c)
+	require.Zero(t, ref)
+	require.NotNil(t, nativePool.acquire(c))
+	nativePool.incrRef()
+	require.NoError(t, p.Redial())
+	require.EqualValues(t, 1, atomic.LoadInt32(&c.retired))
+
+	// the connection is closed by its new borrower, not under it.
+	require.NoError(t, c.releaseRetired(ref))
+	require.NotEqual(t, connectivity.Shutdown, c.cc.GetState())
+	require.NoError(t, c.Close())
+	require.Equal(t, connectivity.Shutdown, c.cc.GetState())
+	require.Zero(t, p.Stats().Ref)
+}
+
+func TestStrict(t *testing.T) {
+	p, _, err := newPool(MaxIdle(1), Strict(true))
+	require.NoError(t, err)
+	defer p.Close()
+
+	borrowed, err := p.Get()
+	require.NoError(t, err)
+	require.NoError(t, borrowed.Close())
+	require.PanicsWithError(t, "negative reference count: ref -1", func() { _ = borrowed.Close() })
+}
+
+func TestSnapshot(t *testing.T) {
+	p, nativePool, err := newPool(MaxIdle(2), MaxActive(8), MaxConcurrentStreams(1))
+	require.NoError(t, err)
+	defer p.Close()
+
+	// the readers never see a nil value while the writers grow, shrink, resize and re-dial.
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				borrowed, err := p.Get()
+				if err != nil {
+					continue
+				}
+				require.NotNil(t, borrowed.Value())
+				require.NoError(t, borrowed.Close())
+			}
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		require.NoError(t, p.Reconfigure(MaxActive(4+i%2*4)))
+		require.NoError(t, p.Redial())
+	}
+	close(done)
+	wg.Wait()
+
+	// a snapshot is never modified by the writers.
+	old := nativePool.snapshot()
+	first := old[0]
+	require.NoError(t, p.Redial())
+	require.True(t, old[0] == first)
+	require.True(t, nativePool.snapshot()[0] != first)
+}
+
+// BenchmarkGetClose measures the overhead of the pool alone, without RPCs.
+func BenchmarkGetClose(b *testing.B) {
+	for _, policy := range []struct {
+		name   string
+		pick   PickPolicy
+		shards int
+		block  bool
+	}{
+		{"roundRobin", RoundRobinPick, 0, false},
+		{"leastLoaded", LeastLoadedPick, 0, false},
+		{"fastest", FastestPick, 0, false},
+		{"sharded", RoundRobinPick, 4, false},
+		{"block", RoundRobinPick, 0, true},
+		{"blockSharded", RoundRobinPick, 4, true},
+	} {
+		for _, parallelism := range []int{1, 4, 16, 64} {
+			b.Run(fmt.Sprintf("%s/parallelism-%d", policy.name, parallelism), func(b *testing.B) {
+				p, _, err := newPool(MaxIdle(8), MaxActive(8), Pick(policy.pick), Shards(policy.shards), Block(policy.block))
+				if err != nil {
+					b.Fatalf("failed to new pool: %v", err)
+				}
+				defer p.Close()
+
+				b.ReportAllocs()
+				b.SetParallelism(parallelism)
+				b.ResetTimer()
+				b.RunParallel(func(tpb *testing.PB) {
+					for tpb.Next() {
+						borrowed, err := p.Get()
+						if err != nil {
+							b.Fatalf("failed to get conn: %v", err)
+						}
+						_ = borrowed.Close()
+					}
+				})
+			})
+		}
+	}
+}
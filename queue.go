@@ -0,0 +1,206 @@
+// Copyright 2023 chengyayu. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpcpool
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// QueueOrder is the order the waiting Gets are served in, see Block.
+type QueueOrder int
+
+const (
+	// FIFOOrder serves the longest waiting Get first, the default order.
+	FIFOOrder QueueOrder = iota
+
+	// LIFOOrder serves the latest Get first. Under overload the oldest Gets are likely to
+	// exceed their deadlines anyway, serving the latest ones keeps the tail latency of the
+	// served Gets low while the oldest ones time out.
+	LIFOOrder
+)
+
+// waiter is a Get waiting for a borrowed connection to be closed.
+type waiter struct {
+	// ready receives the connection handed over by its borrower, nil if the pool is closed.
+	ready chan *conn
+
+	// elem is the element of the waiter in the queue, nil once it's removed. guarded by waitQueue.mu.
+	elem *list.Element
+}
+
+// waitQueue is the queue of the waiting Gets.
+type waitQueue struct {
+	mu sync.Mutex
+
+	// the *waiter in the order they arrived.
+	waiters list.List
+
+	// atomic, the length of waiters, so the releases check it without locking.
+	n int32
+
+	// closed is set by Close, guarded by mu.
+	closed bool
+}
+
+// push queues w, it returns false if the pool is closed or the queue has max waiters.
+// max zero means unlimited.
+func (q *waitQueue) push(w *waiter, max int) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed || (max > 0 && q.waiters.Len() >= max) {
+		return false
+	}
+	w.elem = q.waiters.PushBack(w)
+	atomic.AddInt32(&q.n, 1)
+	return true
+}
+
+// remove removes w, it returns false if w is already served.
+func (q *waitQueue) remove(w *waiter) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.removeLocked(w)
+}
+
+func (q *waitQueue) removeLocked(w *waiter) bool {
+	if w.elem == nil {
+		return false
+	}
+	q.waiters.Remove(w.elem)
+	w.elem = nil
+	atomic.AddInt32(&q.n, -1)
+	return true
+}
+
+// handOver hands c over to the next waiter in order, it returns false if there is none.
+func (q *waitQueue) handOver(c *conn, order QueueOrder) bool {
+	q.mu.Lock()
+	e := q.waiters.Front()
+	if order == LIFOOrder {
+		e = q.waiters.Back()
+	}
+	if e == nil {
+		q.mu.Unlock()
+		return false
+	}
+	w := e.Value.(*waiter)
+	q.removeLocked(w)
+	q.mu.Unlock()
+	w.ready <- c
+	return true
+}
+
+// close wakes up all the waiters with ErrClosed and rejects the later ones.
+func (q *waitQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	for e := q.waiters.Front(); e != nil; e = q.waiters.Front() {
+		w := e.Value.(*waiter)
+		q.removeLocked(w)
+		w.ready <- nil
+	}
+}
+
+// wait queues the Get until a borrower closes its connection, ctx is done or the pool is closed.
+// The Get holds a reference of the pool, it's released while it's waiting, since the connection
+// handed over is borrowed for the waiter already, along with a reference of the pool.
+func (p *pool) wait(ctx context.Context, o *options) (Conn, error) {
+	w := &waiter{ready: make(chan *conn, 1)}
+	if !p.queue.push(w, o.maxWaiting) {
+		p.decrRef()
+		if atomic.LoadInt32(&p.closed) == 1 {
+			return nil, ErrClosed
+		}
+		// 等待队列已满，快速失败
+		atomic.AddUint64(&p.shed, 1)
+		return nil, ErrPoolExhausted
+	}
+	p.ref.add(procHint(), -1)
+	atomic.AddUint64(&p.waits, 1)
+	start := time.Now()
+	defer func() { atomic.AddInt64(&p.waitTime, int64(time.Since(start))) }()
+
+	// 入队前归还的连接没有交给等待者，入队后按顺序交接有余量的连接。
+	p.serveWaiters()
+
+	select {
+	case c := <-w.ready:
+		if c == nil {
+			return nil, ErrClosed
+		}
+		return c, nil
+	case <-ctx.Done():
+		if p.queue.remove(w) {
+			return nil, getError(ctx)
+		}
+		// 取消的同时被交接了连接，像借用者一样归还，转交给下一个等待者
+		if c := <-w.ready; c != nil {
+			_ = c.Close()
+		}
+		return nil, getError(ctx)
+	}
+}
+
+// releaseRef releases the reference of the pool a borrower of c holds, or hands c and the
+// reference over to a waiting Get. c must be released by the borrower before.
+func (p *pool) releaseRef(c *conn) {
+	// 没有等待者时直接归还，入队与归还并发时由入队后的 serveWaiters 交接；
+	// 关闭阻塞模式后仍要唤醒已在队列中的等待者。
+	if atomic.LoadInt32(&p.queue.n) == 0 {
+		p.decrRef()
+		return
+	}
+	o := p.options()
+	// 交接前为等待者重新借出连接，避免同一个余量被交接多次
+	if p.acquire(c) != nil {
+		if p.queue.handOver(c, o.waitOrder) {
+			return
+		}
+		_ = c.unref()
+		p.decrRef()
+		return
+	}
+	// 退役的连接不再交接，改为交接替换它的连接
+	p.decrRef()
+	p.serveWaiters()
+}
+
+// serveWaiters hands the connections having room over to the waiting Gets in order, and grows
+// the pool for the rest if it's below the limit. Besides the borrowers closing their connections,
+// it serves the waiters when the connections change, e.g. by a growth, Redial or Reconfigure.
+func (p *pool) serveWaiters() {
+	for atomic.LoadInt32(&p.queue.n) > 0 {
+		o := p.options()
+		c := p.acquireFree(o)
+		if c == nil {
+			// 没有余量时为等待者扩容，新连接发布后再次交接
+			if p.current() < o.limit {
+				p.growAsync()
+			}
+			return
+		}
+		p.incrRef()
+		if !p.queue.handOver(c, o.waitOrder) {
+			_ = c.unref()
+			p.decrRef()
+			return
+		}
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright 2023 chengyayu. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpcpool
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestBlock(t *testing.T) {
+	p, _, err := newPool(MaxIdle(1), MaxActive(1), MaxConcurrentStreams(1), Block(true))
+	require.NoError(t, err)
+	defer p.Close()
+
+	borrowed, err := p.Get()
+	require.NoError(t, err)
+
+	got := make(chan Conn)
+	go func() {
+		c, err := p.Get()
+		require.NoError(t, err)
+		got <- c
+	}()
+	require.Eventually(t, func() bool { return p.Stats().Waiting == 1 }, time.Second, time.Millisecond)
+	require.Equal(t, 1, p.Stats().Ref)
+
+	// the closed connection is handed over to the waiting Get.
+	time.Sleep(5 * time.Millisecond)
+	require.NoError(t, borrowed.Close())
+	waited := <-got
+	require.True(t, waited.Value() == borrowed.Value())
+
+	stats := p.Stats()
+	require.Zero(t, stats.Waiting)
+	require.EqualValues(t, 1, stats.Waits)
+	require.GreaterOrEqual(t, stats.WaitTime, 5*time.Millisecond)
+	require.Zero(t, stats.Overflows)
+	require.Equal(t, 1, stats.Ref)
+	require.Equal(t, 1, stats.Conns[0].Ref)
+
+	// the Get gives up waiting when its context is done.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = p.GetContext(ctx)
+	require.ErrorIs(t, err, ErrGetTimeout)
+	require.Zero(t, p.Stats().Waiting)
+
+	require.NoError(t, waited.Close())
+	require.Zero(t, p.Stats().Ref)
+	require.Zero(t, p.Stats().Conns[0].Ref)
+
+	// without waiters, the closed connection is free for the next Get.
+	borrowed, err = p.Get()
+	require.NoError(t, err)
+	require.NoError(t, borrowed.Close())
+}
+
+func TestMaxWaiting(t *testing.T) {
+	p, _, err := newPool(MaxIdle(1), MaxActive(1), MaxConcurrentStreams(1), Block(true), MaxWaiting(1))
+	require.NoError(t, err)
+	defer p.Close()
+
+	borrowed, err := p.Get()
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, err := p.GetContext(ctx)
+		done <- err
+	}()
+	require.Eventually(t, func() bool { return p.Stats().Waiting == 1 }, time.Second, time.Millisecond)
+
+	// the queue is full, the Get fails fast.
+	_, err = p.Get()
+	require.ErrorIs(t, err, ErrPoolExhausted)
+	require.EqualValues(t, 1, p.Stats().Shed)
+
+	cancel()
+	require.ErrorIs(t, <-done, context.Canceled)
+	stats := p.Stats()
+	require.Zero(t, stats.Waiting)
+	require.Equal(t, 1, stats.Ref)
+	require.NoError(t, borrowed.Close())
+	require.Zero(t, p.Stats().Ref)
+
+	require.Error(t, p.Reconfigure(MaxWaiting(-1)))
+	require.Error(t, p.Reconfigure(WaitOrder(LIFOOrder+1)))
+}
+
+func TestWaitOrder(t *testing.T) {
+	for order, want := range map[QueueOrder][]int{FIFOOrder: {0, 1, 2}, LIFOOrder: {2, 1, 0}} {
+		p, _, err := newPool(MaxIdle(1), MaxActive(1), MaxConcurrentStreams(1), Block(true), WaitOrder(order))
+		require.NoError(t, err)
+
+		borrowed, err := p.Get()
+		require.NoError(t, err)
+		served := make(chan int, len(want))
+		for i := range want {
+			go func(i int) {
+				c, err := p.Get()
+				require.NoError(t, err)
+				served <- i
+				require.NoError(t, c.Close())
+			}(i)
+			require.Eventually(t, func() bool { return p.Stats().Waiting == i+1 }, time.Second, time.Millisecond)
+		}
+
+		require.NoError(t, borrowed.Close())
+		got := make([]int, 0, len(want))
+		for range want {
+			got = append(got, <-served)
+		}
+		require.Equal(t, want, got, "order %d", order)
+		require.Eventually(t, func() bool { return p.Stats().Ref == 0 }, time.Second, time.Millisecond)
+		p.Close()
+	}
+}
+
+func TestBlockRedial(t *testing.T) {
+	p, _, err := newPool(MaxIdle(1), MaxActive(1), MaxConcurrentStreams(1), Block(true))
+	require.NoError(t, err)
+	defer p.Close()
+
+	borrowed, err := p.Get()
+	require.NoError(t, err)
+	got := make(chan Conn)
+	go func() {
+		c, err := p.Get()
+		require.NoError(t, err)
+		got <- c
+	}()
+	require.Eventually(t, func() bool { return p.Stats().Waiting == 1 }, time.Second, time.Millisecond)
+
+	// the replacement of the borrowed connection is free, it's handed over to the waiter.
+	require.NoError(t, p.Redial())
+	waited := <-got
+	require.True(t, waited.Value() != borrowed.Value())
+	require.NoError(t, borrowed.Close())
+
+	stats := p.Stats()
+	require.Zero(t, stats.Waiting)
+	require.Equal(t, 1, stats.Ref)
+	require.Equal(t, 1, stats.Conns[0].Ref)
+	require.NoError(t, waited.Close())
+	require.Zero(t, p.Stats().Ref)
+}
+
+func TestBlockReconfigure(t *testing.T) {
+	p, _, err := newPool(MaxIdle(1), MaxActive(1), MaxConcurrentStreams(1), Block(true))
+	require.NoError(t, err)
+	defer p.Close()
+
+	borrowed, err := p.Get()
+	require.NoError(t, err)
+	got := make(chan Conn, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			c, err := p.Get()
+			require.NoError(t, err)
+			got <- c
+		}()
+	}
+	require.Eventually(t, func() bool { return p.Stats().Waiting == 2 }, time.Second, time.Millisecond)
+
+	// the pool grows for the waiters under the new limit.
+	require.NoError(t, p.Reconfigure(MaxActive(4)))
+	waited := []Conn{<-got, <-got}
+	stats := p.Stats()
+	require.Zero(t, stats.Waiting)
+	require.GreaterOrEqual(t, stats.Current, 3)
+	require.Equal(t, 3, stats.Ref)
+	for _, c := range stats.Conns {
+		require.LessOrEqual(t, c.Ref, 1)
+	}
+	for _, c := range append(waited, borrowed) {
+		require.NoError(t, c.Close())
+	}
+	require.Zero(t, p.Stats().Ref)
+}
+
+func TestBlockClose(t *testing.T) {
+	p, _, err := newPool(MaxIdle(1), MaxActive(1), MaxConcurrentStreams(1), Block(true))
+	require.NoError(t, err)
+
+	borrowed, err := p.Get()
+	require.NoError(t, err)
+	done := make(chan error)
+	go func() {
+		_, err := p.Get()
+		done <- err
+	}()
+	require.Eventually(t, func() bool { return p.Stats().Waiting == 1 }, time.Second, time.Millisecond)
+
+	p.Close()
+	require.ErrorIs(t, <-done, ErrClosed)
+	require.Zero(t, p.Stats().Waiting)
+	require.NoError(t, borrowed.Close())
+}
@@ -0,0 +1,191 @@
+// Copyright 2023 chengyayu. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpcpool
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DftConfigReloadInterval is the default interval a ConfigWatcher checks the config file.
+const DftConfigReloadInterval = 10 * time.Second
+
+// Reconfigurer applies options to something live, e.g. a Pool.
+type Reconfigurer interface {
+	Reconfigure(opts ...Option) error
+}
+
+// ConfigWatcher watches a config file loaded by LoadConfig and applies the changes to a
+// Reconfigurer. An invalid file or a rejected update is logged and the last good
+// configuration is kept. When the dial settings change and the target has a Redial
+// method, e.g. a Pool, its connections are re-dialed with the new settings in the background.
+type ConfigWatcher struct {
+	path     string
+	interval time.Duration
+	target   Reconfigurer
+	logf     func(format string, v ...interface{})
+
+	// opts are applied after the options of every reloaded configuration.
+	opts []Option
+
+	mu      sync.Mutex
+	current Config
+	stamp   fileStamp
+	done    chan struct{}
+	once    sync.Once
+}
+
+// NewConfigWatcher loads the file at path and starts to check it every interval.
+// The target is expected to be created from the loaded configuration, see Config, and opts
+// are the options passed to NewFromConfig with it, e.g. Dial or Pick. They are applied after
+// every reloaded configuration, otherwise the reload resets them to the file values.
+// When interval is not positive, DftConfigReloadInterval is used. When logf is nil, log.Printf is used.
+func NewConfigWatcher(path string, interval time.Duration, target Reconfigurer, logf func(format string, v ...interface{}), opts ...Option) (*ConfigWatcher, error) {
+	if interval <= 0 {
+		interval = DftConfigReloadInterval
+	}
+	if logf == nil {
+		logf = log.Printf
+	}
+	c, err := LoadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	w := &ConfigWatcher{
+		path:     path,
+		interval: interval,
+		target:   target,
+		logf:     logf,
+		opts:     opts,
+		current:  *c,
+		stamp:    statFile(path),
+		done:     make(chan struct{}),
+	}
+	go w.watch()
+	return w, nil
+}
+
+// Config returns the last good configuration.
+func (w *ConfigWatcher) Config() Config {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.current
+}
+
+// Close stops watching the file.
+func (w *ConfigWatcher) Close() {
+	w.once.Do(func() { close(w.done) })
+}
+
+func (w *ConfigWatcher) watch() {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+			w.check()
+		}
+	}
+}
+
+// check applies the file if it changed since the last check.
+func (w *ConfigWatcher) check() {
+	stamp := statFile(w.path)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if stamp == w.stamp {
+		return
+	}
+	// 无论成败都记录本次的文件状态，避免每个周期重复报告同一个错误。
+	w.stamp = stamp
+
+	next, err := LoadConfig(w.path)
+	if err != nil {
+		w.logf("grpcpool: rejected config %s, keep the last good one: %v", w.path, err)
+		return
+	}
+	diffs := diffConfig("", reflect.ValueOf(w.current), reflect.ValueOf(*next))
+	if len(diffs) == 0 {
+		return
+	}
+	if next.Address != w.current.Address {
+		w.logf("grpcpool: rejected config %s, address can't be changed at runtime", w.path)
+		return
+	}
+	opts, _ := next.Options()
+	// 创建时额外传入的选项覆盖配置文件，重新加载后保持不变
+	if err := w.target.Reconfigure(append(opts, w.opts...)...); err != nil {
+		w.logf("grpcpool: rejected config %s, keep the last good one: %v", w.path, err)
+		return
+	}
+	dialChanged := !reflect.DeepEqual(w.current.Dial, next.Dial)
+	w.current = *next
+	w.logf("grpcpool: applied config %s: %s", w.path, strings.Join(diffs, ", "))
+
+	if r, ok := w.target.(interface{ Redial() error }); ok && dialChanged {
+		// 滚动重连可能持续 current × DialTimeout，在后台进行，不阻塞 Config 与后续的检查
+		go func() {
+			if err := r.Redial(); err != nil {
+				w.logf("grpcpool: redial after config %s changed: %v", w.path, err)
+			}
+		}()
+	}
+}
+
+func statFile(path string) fileStamp {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{modTime: fi.ModTime(), size: fi.Size()}
+}
+
+// diffConfig returns the changed fields of the structs a and b as "name: old -> new",
+// named by the json tags and joined by dots for the nested ones.
+func diffConfig(prefix string, a, b reflect.Value) []string {
+	var diffs []string
+	for i := 0; i < a.NumField(); i++ {
+		name := prefix + strings.Split(a.Type().Field(i).Tag.Get("json"), ",")[0]
+		fa, fb := a.Field(i), b.Field(i)
+		if fa.Kind() == reflect.Ptr && !fa.IsNil() && !fb.IsNil() {
+			fa, fb = fa.Elem(), fb.Elem()
+		}
+		if fa.Kind() == reflect.Struct && fa.Type() == fb.Type() {
+			diffs = append(diffs, diffConfig(name+".", fa, fb)...)
+			continue
+		}
+		if !reflect.DeepEqual(fa.Interface(), fb.Interface()) {
+			diffs = append(diffs, fmt.Sprintf("%s: %v -> %v", name, formatValue(fa), formatValue(fb)))
+		}
+	}
+	return diffs
+}
+
+func formatValue(v reflect.Value) interface{} {
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return "<nil>"
+		}
+		return v.Elem().Interface()
+	}
+	return v.Interface()
+}
@@ -0,0 +1,123 @@
+// Copyright 2023 chengyayu. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpcpool
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConfigWatcher(t *testing.T) {
+	path := writeFile(t, "pool.yaml", fmt.Sprintf("address: %s\nmaxIdle: 2\nmaxActive: 4\n", *endpoint))
+	c, err := LoadConfig(path)
+	require.NoError(t, err)
+	p, err := NewFromConfig(*c)
+	require.NoError(t, err)
+	defer p.Close()
+
+	var (
+		mu   sync.Mutex
+		logs []string
+	)
+	logf := func(format string, v ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		logs = append(logs, fmt.Sprintf(format, v...))
+	}
+	lastLog := func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(logs) == 0 {
+			return ""
+		}
+		return logs[len(logs)-1]
+	}
+
+	w, err := NewConfigWatcher(path, 10*time.Millisecond, p, logf)
+	require.NoError(t, err)
+	defer w.Close()
+
+	require.NoError(t, os.WriteFile(path, []byte(fmt.Sprintf("address: %s\nmaxIdle: 2\nmaxActive: 16\n", *endpoint)), 0600))
+	require.Eventually(t, func() bool { return p.Stats().MaxActive == 16 }, time.Second, 10*time.Millisecond)
+	require.Equal(t, 16, w.Config().MaxActive)
+	require.Eventually(t, func() bool { return strings.Contains(lastLog(), "maxActive: 4 -> 16") }, time.Second, 10*time.Millisecond)
+
+	// invalid updates are rejected, the last good configuration is kept.
+	require.NoError(t, os.WriteFile(path, []byte(fmt.Sprintf("address: %s\nmaxIdle: 32\nmaxActive: 16\n", *endpoint)), 0600))
+	require.Eventually(t, func() bool { return strings.Contains(lastLog(), "rejected") }, time.Second, 10*time.Millisecond)
+	require.Equal(t, 16, p.Stats().MaxActive)
+	require.Equal(t, 2, w.Config().MaxIdle)
+
+	require.NoError(t, os.WriteFile(path, []byte("address: 127.0.0.1:1\nmaxIdle: 2\nmaxActive: 16\n"), 0600))
+	require.Eventually(t, func() bool { return strings.Contains(lastLog(), "address can't be changed") }, time.Second, 10*time.Millisecond)
+	require.Equal(t, *endpoint, w.Config().Address)
+}
+
+func TestConfigWatcherOptions(t *testing.T) {
+	path := writeFile(t, "pool.yaml", fmt.Sprintf("address: %s\nmaxIdle: 2\nmaxActive: 4\n", *endpoint))
+	c, err := LoadConfig(path)
+	require.NoError(t, err)
+	opts := []Option{Dial(DialTest), Pick(LeastLoadedPick)}
+	p, err := NewFromConfig(*c, opts...)
+	require.NoError(t, err)
+	defer p.Close()
+
+	w, err := NewConfigWatcher(path, 10*time.Millisecond, p, func(string, ...interface{}) {}, opts...)
+	require.NoError(t, err)
+	defer w.Close()
+
+	// the options passed with the configuration keep overriding the file.
+	require.NoError(t, os.WriteFile(path, []byte(fmt.Sprintf("address: %s\nmaxIdle: 2\nmaxActive: 16\n", *endpoint)), 0600))
+	require.Eventually(t, func() bool { return p.Stats().MaxActive == 16 }, time.Second, 10*time.Millisecond)
+	o := p.(*pool).options()
+	require.Nil(t, o.dialConfig)
+	require.NotNil(t, o.dial)
+	require.Equal(t, LeastLoadedPick, o.pick)
+}
+
+// redialTarget is a Reconfigurer whose Redial blocks until release is closed.
+type redialTarget struct {
+	redialing chan struct{}
+	release   chan struct{}
+}
+
+func (r *redialTarget) Reconfigure(...Option) error { return nil }
+
+func (r *redialTarget) Redial() error {
+	r.redialing <- struct{}{}
+	<-r.release
+	return nil
+}
+
+func TestConfigWatcherRedial(t *testing.T) {
+	path := writeFile(t, "pool.yaml", fmt.Sprintf("address: %s\nmaxIdle: 2\ndial:\n  timeout: 1s\n", *endpoint))
+	target := &redialTarget{redialing: make(chan struct{}, 1), release: make(chan struct{})}
+	defer close(target.release)
+	w, err := NewConfigWatcher(path, 10*time.Millisecond, target, func(string, ...interface{}) {})
+	require.NoError(t, err)
+	defer w.Close()
+
+	// the re-dial of the changed dial settings doesn't block the watcher.
+	require.NoError(t, os.WriteFile(path, []byte(fmt.Sprintf("address: %s\nmaxIdle: 2\ndial:\n  timeout: 20s\n", *endpoint)), 0600))
+	<-target.redialing
+	require.Equal(t, 20*time.Second, time.Duration(w.Config().Dial.Timeout))
+	require.NoError(t, os.WriteFile(path, []byte(fmt.Sprintf("address: %s\nmaxIdle: 10\ndial:\n  timeout: 20s\n", *endpoint)), 0600))
+	require.Eventually(t, func() bool { return w.Config().MaxIdle == 10 }, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,98 @@
+// Copyright 2023 chengyayu. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpcpool
+
+import (
+	"sync/atomic"
+)
+
+// shard is the state of a shard living across the snapshots of the connections, see Shards.
+// The connections of a shard are in connSet.shards.
+type shard struct {
+	// atomic, the Gets on the Ps of this shard served by another shard.
+	steals uint64
+	_      [cacheLine - 8]byte
+
+	// the round robin counter of the shard.
+	index paddedInt32
+}
+
+// newShards returns the shards of the pool, nil if it's not sharded.
+func newShards(n int) []shard {
+	if n <= 1 {
+		return nil
+	}
+	return make([]shard, n)
+}
+
+// partition splits conns into the shards by their index modulo the shards,
+// nil if the pool is not sharded.
+func (p *pool) partition(conns []*conn) [][]*conn {
+	n := len(p.shards)
+	if n == 0 {
+		return nil
+	}
+	shards := make([][]*conn, n)
+	for i, c := range conns {
+		shards[i%n] = append(shards[i%n], c)
+	}
+	return shards
+}
+
+// tryPickSharded borrows a connection having room for one more borrower from the shard home,
+// or steals one from the next shards when it is saturated. It returns nil if all of them are.
+func (p *pool) tryPickSharded(o *options, home int) Conn {
+	shards := p.conns.Load().shards
+	n := len(shards)
+	now := o.now()
+	for i := 0; i < n; i++ {
+		s := (home + i) % n
+		conns := shards[s]
+		if len(conns) == 0 {
+			continue
+		}
+		c := o.choose(conns, &p.shards[s].index, now)
+		if o.needGrow(c.load()+1, int32(c.streams(o))) || p.acquire(c) == nil {
+			continue
+		}
+		if i > 0 {
+			atomic.AddUint64(&p.shards[home].steals, 1)
+		}
+		return c
+	}
+	return nil
+}
+
+// shardStats returns the stats of the shards of the snapshot set.
+func (p *pool) shardStats(set *connSet) []ShardStat {
+	if len(p.shards) == 0 {
+		return nil
+	}
+	stats := make([]ShardStat, len(p.shards))
+	for i := range p.shards {
+		s := ShardStat{Index: i, Steals: atomic.LoadUint64(&p.shards[i].steals)}
+		if i < len(set.shards) {
+			for _, c := range set.shards[i] {
+				s.Current++
+				s.Ref += int(atomic.LoadInt32(&c.ref))
+				if c.tracker != nil {
+					s.InFlight += int(atomic.LoadInt32(&c.tracker.inflight))
+				}
+			}
+		}
+		stats[i] = s
+	}
+	return stats
+}
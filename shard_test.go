@@ -0,0 +1,112 @@
+// Copyright 2023 chengyayu. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpcpool
+
+import (
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+)
+
+func TestShards(t *testing.T) {
+	p, nativePool, err := newPool(MaxIdle(4), MaxActive(4), MaxConcurrentStreams(1), Shards(2))
+	require.NoError(t, err)
+	defer p.Close()
+
+	stats := p.Stats()
+	require.Len(t, stats.Shards, 2)
+	for i, s := range stats.Shards {
+		require.Equal(t, ShardStat{Index: i, Current: 2}, s)
+	}
+	require.Len(t, nativePool.conns.Load().shards[0], 2)
+	require.True(t, nativePool.conns.Load().shards[1][0] == nativePool.snapshot()[1])
+
+	// the home shard serves the first two picks, the others are stolen from the other shard.
+	o := nativePool.options()
+	conns := make([]Conn, 4)
+	for i := range conns {
+		conns[i] = nativePool.tryPickSharded(o, 0)
+		require.NotNil(t, conns[i])
+	}
+	require.Nil(t, nativePool.tryPickSharded(o, 0))
+	stats = p.Stats()
+	require.EqualValues(t, 2, stats.Shards[0].Steals)
+	require.Zero(t, stats.Shards[1].Steals)
+	for _, s := range stats.Shards {
+		require.Equal(t, 2, s.Ref)
+	}
+	for _, c := range conns {
+		require.NoError(t, c.(*conn).unref())
+	}
+
+	// the Gets spread over the shards wherever they run.
+	for i := range conns {
+		conns[i], err = p.Get()
+		require.NoError(t, err)
+	}
+	stats = p.Stats()
+	require.Zero(t, stats.Overflows)
+	for _, c := range stats.Conns {
+		require.Equal(t, 1, c.Ref)
+	}
+
+	// all shards saturated, the Get falls back to the pool wide pick.
+	borrowed, err := p.Get()
+	require.NoError(t, err)
+	require.EqualValues(t, 1, p.Stats().Overflows)
+	require.NoError(t, borrowed.Close())
+	for _, c := range conns {
+		require.NoError(t, c.Close())
+	}
+	require.Zero(t, p.Stats().Ref)
+
+	var configErr *ConfigError
+	require.ErrorAs(t, p.Reconfigure(Shards(4)), &configErr)
+	require.Equal(t, "shards", configErr.Field)
+	require.NoError(t, p.Reconfigure(MaxActive(8)))
+
+	_, err = New(*endpoint, Dial(DialTest), Shards(-1))
+	require.Error(t, err)
+}
+
+func TestShardsConcurrent(t *testing.T) {
+	p, _, err := newPool(MaxIdle(2), MaxActive(8), MaxConcurrentStreams(2), Shards(4))
+	require.NoError(t, err)
+	defer p.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				borrowed, err := p.Get()
+				require.NoError(t, err)
+				require.NotNil(t, borrowed.Value())
+				require.NoError(t, borrowed.Close())
+			}
+		}()
+	}
+	wg.Wait()
+
+	stats := p.Stats()
+	require.Zero(t, stats.Ref)
+	current := 0
+	for _, s := range stats.Shards {
+		require.Zero(t, s.Ref)
+		current += s.Current
+	}
+	require.Equal(t, stats.Current, current)
+}
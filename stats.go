@@ -0,0 +1,136 @@
+// Copyright 2023 chengyayu. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpcpool
+
+import "time"
+
+// Stats is the snapshot of a pool for monitoring.
+type Stats struct {
+	// Address is the server address of the pool.
+	Address string
+
+	// Closed is true after the pool is closed.
+	Closed bool
+
+	// Current is the number of physical connections.
+	Current int
+
+	// Ref is the number of borrowed logic connections.
+	Ref int
+
+	// InFlight is the number of RPCs in flight on the physical connections.
+	// It requires the default dial or WithDialConfig.
+	InFlight int
+
+	// Capacity is the number of logic connections the physical connections serve
+	// before the pool grows, see AdaptiveStreams.
+	Capacity int
+
+	// MaxActive is the configured maximum of physical connections, zero means unlimited.
+	MaxActive int
+
+	// Limit is the effective maximum of physical connections,
+	// the safety cap UnlimitedCap when MaxActive is zero.
+	Limit int
+
+	// Storage is the number of allocated slots for physical connections.
+	Storage int
+
+	// Overflows counts the Gets exceeding the capacity when the pool is at the limit,
+	// they reuse a pooled connection or dial a one-shot one.
+	Overflows uint64
+
+	// OneShots is the number of one-shot connections not closed yet, see MaxOneShot.
+	OneShots int
+
+	// RejectedDials counts the growth and one-shot dials rejected by MaxOneShot and DialRate.
+	RejectedDials uint64
+
+	// RefErrors counts the misuses of the reference count, e.g. a connection closed twice, see OnError.
+	RefErrors uint64
+
+	// RedialErrors counts the failed re-dials triggered by the notifiers, see RedialOn.
+	RedialErrors uint64
+
+	// Waiting is the number of Gets in the wait queue, see Block.
+	Waiting int
+
+	// Waits counts the Gets queued, WaitTime is their total time in the queue,
+	// WaitTime / Waits is the average wait.
+	Waits    uint64
+	WaitTime time.Duration
+
+	// Shed counts the Gets rejected with ErrPoolExhausted because the wait queue was full, see MaxWaiting.
+	Shed uint64
+
+	// CircuitOpen is true while the dials fail fast, see CircuitBreaker.
+	CircuitOpen bool
+
+	// Ejections counts the times a connection was ejected as an outlier, see DetectOutliers.
+	Ejections uint64
+
+	// Conns are the stats of the physical connections.
+	Conns []ConnStat
+
+	// Shards are the stats of the shards, nil if the pool is not sharded, see Shards.
+	Shards []ShardStat
+}
+
+// ShardStat is the snapshot of a shard of the pool.
+type ShardStat struct {
+	// Index is the position of the shard.
+	Index int
+
+	// Current is the number of its physical connections, Ref and InFlight are their sum.
+	Current  int
+	Ref      int
+	InFlight int
+
+	// Steals counts the Gets on the shard served by another shard because it was saturated.
+	Steals uint64
+}
+
+// ConnStat is the snapshot of a physical connection in the pool.
+type ConnStat struct {
+	// Index is the position of the connection in the pool.
+	Index int
+
+	// CreatedAt is when the connection was dialed.
+	CreatedAt time.Time
+
+	// LastUsed is when the connection was released by all its borrowers last time, zero if never.
+	LastUsed time.Time
+
+	// Ref is the number of borrowed references.
+	Ref int
+
+	// Streams is the number of logic connections the connection serves, see AdaptiveStreams.
+	Streams int
+
+	// InFlight is the number of RPCs in flight, BytesSent and BytesReceived are the
+	// wire bytes of the messages, LastActive is the time of the last RPC event, zero if never.
+	// They require the default dial or WithDialConfig.
+	InFlight      int
+	BytesSent     int64
+	BytesReceived int64
+	LastActive    time.Time
+
+	// Latency is the moving average of the unary RPC latency, zero before the first RPC.
+	// It requires the default dial or WithDialConfig.
+	Latency time.Duration
+
+	// Ejected is true while the connection is ejected from the selection as an outlier.
+	Ejected bool
+}
@@ -0,0 +1,240 @@
+// Copyright 2023 chengyayu. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpcpool
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"google.golang.org/grpc/credentials"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DftCertReloadInterval is the default interval a CertWatcher checks the certificate files.
+const DftCertReloadInterval = 10 * time.Second
+
+// TLSConfig loads TLS or mTLS client credentials from PEM files.
+type TLSConfig struct {
+	// CAFile is the root certificates to verify the server, empty uses the system roots.
+	CAFile string `json:"caFile" yaml:"caFile"`
+
+	// CertFile and KeyFile are the client certificate of mTLS, both or neither must be set.
+	CertFile string `json:"certFile" yaml:"certFile"`
+	KeyFile  string `json:"keyFile" yaml:"keyFile"`
+
+	// ServerName overrides the name used to verify the server certificate.
+	ServerName string `json:"serverName" yaml:"serverName"`
+
+	// InsecureSkipVerify disables verification of the server certificate, for testing only.
+	InsecureSkipVerify bool `json:"insecureSkipVerify" yaml:"insecureSkipVerify"`
+}
+
+// Validate reports invalid or conflicting settings.
+func (t TLSConfig) Validate() error {
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return configError("tls", "cert file and key file must be set together")
+	}
+	return nil
+}
+
+// Credentials loads the files once and returns static transport credentials.
+func (t TLSConfig) Credentials() (credentials.TransportCredentials, error) {
+	c, err := t.load()
+	if err != nil {
+		return nil, err
+	}
+	return credentials.NewTLS(c), nil
+}
+
+func (t TLSConfig) load() (*tls.Config, error) {
+	if err := t.Validate(); err != nil {
+		return nil, err
+	}
+	c := &tls.Config{
+		ServerName:         t.ServerName,
+		InsecureSkipVerify: t.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if t.CAFile != "" {
+		pem, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read ca file: %w", err)
+		}
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in ca file %s", t.CAFile)
+		}
+	}
+	if t.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load key pair: %w", err)
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	return c, nil
+}
+
+// files returns the files the configuration depends on.
+func (t TLSConfig) files() []string {
+	var files []string
+	for _, f := range []string{t.CAFile, t.CertFile, t.KeyFile} {
+		if f != "" {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+// CertWatcher watches the files of a TLSConfig and reloads the credentials when
+// they are rotated on disk. Subscribers, e.g. a pool created with RedialOn(watcher),
+// are notified after every successful reload.
+type CertWatcher struct {
+	notifier
+
+	cfg      TLSConfig
+	interval time.Duration
+	current  atomic.Value // *tls.Config
+	stamps   map[string]fileStamp
+	done     chan struct{}
+	once     sync.Once
+}
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// NewCertWatcher loads the files of cfg and starts to check them every interval.
+// When interval is not positive, DftCertReloadInterval is used.
+func NewCertWatcher(cfg TLSConfig, interval time.Duration) (*CertWatcher, error) {
+	if interval <= 0 {
+		interval = DftCertReloadInterval
+	}
+	w := &CertWatcher{
+		cfg:      cfg,
+		interval: interval,
+		done:     make(chan struct{}),
+	}
+	c, err := cfg.load()
+	if err != nil {
+		return nil, err
+	}
+	w.current.Store(c)
+	w.stamps = w.stat()
+	go w.watch()
+	return w, nil
+}
+
+// Credentials returns transport credentials which always handshake with the latest certificates.
+func (w *CertWatcher) Credentials() credentials.TransportCredentials {
+	return &reloadingCreds{w: w}
+}
+
+// Close stops watching the files.
+func (w *CertWatcher) Close() {
+	w.once.Do(func() { close(w.done) })
+}
+
+func (w *CertWatcher) watch() {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+			w.check()
+		}
+	}
+}
+
+// check reloads the credentials if any file changed. a half written file fails
+// to load, the old credentials are kept and the next tick retries.
+func (w *CertWatcher) check() {
+	stamps := w.stat()
+	if stampsEqual(stamps, w.stamps) {
+		return
+	}
+	c, err := w.cfg.load()
+	if err != nil {
+		return
+	}
+	w.stamps = stamps
+	w.current.Store(c)
+	w.notify()
+}
+
+func (w *CertWatcher) stat() map[string]fileStamp {
+	stamps := make(map[string]fileStamp)
+	for _, f := range w.cfg.files() {
+		if fi, err := os.Stat(f); err == nil {
+			stamps[f] = fileStamp{modTime: fi.ModTime(), size: fi.Size()}
+		}
+	}
+	return stamps
+}
+
+func stampsEqual(a, b map[string]fileStamp) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if b[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// reloadingCreds delegates every handshake to the latest credentials of a CertWatcher.
+type reloadingCreds struct {
+	w          *CertWatcher
+	serverName string
+}
+
+func (r *reloadingCreds) creds() credentials.TransportCredentials {
+	c := r.w.current.Load().(*tls.Config).Clone()
+	if r.serverName != "" {
+		c.ServerName = r.serverName
+	}
+	return credentials.NewTLS(c)
+}
+
+func (r *reloadingCreds) ClientHandshake(ctx context.Context, authority string, conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return r.creds().ClientHandshake(ctx, authority, conn)
+}
+
+func (r *reloadingCreds) ServerHandshake(conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return r.creds().ServerHandshake(conn)
+}
+
+func (r *reloadingCreds) Info() credentials.ProtocolInfo {
+	return r.creds().Info()
+}
+
+func (r *reloadingCreds) Clone() credentials.TransportCredentials {
+	return &reloadingCreds{w: r.w, serverName: r.serverName}
+}
+
+func (r *reloadingCreds) OverrideServerName(serverName string) error {
+	r.serverName = serverName
+	return nil
+}
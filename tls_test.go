@@ -0,0 +1,196 @@
+// Copyright 2023 chengyayu. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpcpool
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// writeCert writes a self-signed certificate valid for 127.0.0.1 to dir, returns the cert and key file.
+func writeCert(t *testing.T, dir string, serial int64) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: "grpcpool-test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return certFile, keyFile
+}
+
+func TestTLSConfigValidate(t *testing.T) {
+	require.Error(t, TLSConfig{CertFile: "cert.pem"}.Validate())
+	require.NoError(t, TLSConfig{CAFile: "ca.pem"}.Validate())
+
+	_, err := TLSConfig{CAFile: filepath.Join(t.TempDir(), "missing.pem")}.Credentials()
+	require.Error(t, err)
+
+	c := DefaultDialConfig()
+	c.TLS = &TLSConfig{}
+	require.Error(t, c.Validate())
+	c.Insecure = false
+	require.NoError(t, c.Validate())
+}
+
+func TestCertWatcherRedial(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeCert(t, dir, 1)
+
+	// the server requires the client certificate and trusts the same self-signed certificate.
+	serverCert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(mustParse(t, serverCert))
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	startEchoServer(t, lis, grpc.Creds(credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    roots,
+	})))
+
+	w, err := NewCertWatcher(TLSConfig{CAFile: certFile, CertFile: certFile, KeyFile: keyFile}, 10*time.Millisecond)
+	require.NoError(t, err)
+	defer w.Close()
+
+	c := DefaultDialConfig()
+	c.Insecure, c.Credentials = false, w.Credentials()
+	dial, err := c.Build()
+	require.NoError(t, err)
+
+	p, err := New(lis.Addr().String(), Dial(dial), MaxIdle(2), RedialOn(w))
+	require.NoError(t, err)
+	defer p.Close()
+	nativePool := p.(*pool)
+
+	old := [2]*conn{nativePool.snapshot()[0], nativePool.snapshot()[1]}
+	borrowed, err := p.Get()
+	require.NoError(t, err)
+	require.NoError(t, say(borrowed))
+
+	// rotate the certificate, the pool re-dials all connections.
+	time.Sleep(20 * time.Millisecond)
+	writeCert(t, dir, 2)
+	require.Eventually(t, func() bool {
+		nativePool.Lock()
+		defer nativePool.Unlock()
+		return nativePool.snapshot()[0] != old[0] && nativePool.snapshot()[1] != old[1]
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the borrowed connection keeps working until it's released.
+	require.NotEqual(t, connectivity.Shutdown, borrowed.Value().GetState())
+	require.NoError(t, borrowed.Close())
+	require.Equal(t, connectivity.Shutdown, borrowed.Value().GetState())
+}
+
+func TestRedial(t *testing.T) {
+	n := &notifier{}
+	p, nativePool, err := newPool(MaxIdle(2), RedialOn(n))
+	require.NoError(t, err)
+
+	// the first Get picks conns[1], conns[0] is idle.
+	borrowed, err := p.Get()
+	require.NoError(t, err)
+	idle := nativePool.snapshot()[0]
+	require.True(t, nativePool.snapshot()[1] == borrowed)
+
+	// the pool re-dials in the background.
+	n.notify()
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&borrowed.(*conn).retired) == 1
+	}, time.Second, time.Millisecond)
+	require.True(t, nativePool.snapshot()[0] != idle)
+	require.True(t, nativePool.snapshot()[1] != borrowed)
+	require.Equal(t, connectivity.Shutdown, idle.cc.GetState())
+	require.NotEqual(t, connectivity.Shutdown, borrowed.Value().GetState())
+
+	borrowed.Close()
+	require.Equal(t, connectivity.Shutdown, borrowed.Value().GetState())
+
+	p.Close()
+	require.Len(t, n.subs, 0)
+	require.ErrorIs(t, p.Redial(), ErrClosed)
+}
+
+func TestRedialAsync(t *testing.T) {
+	n := &notifier{}
+	release := make(chan struct{})
+	var dials int32
+	errs := make(chan error, 1)
+	p, err := New(*endpoint, MaxIdle(1), RedialOn(n), OnError(func(err error) { errs <- err }),
+		Dial(func(address string) (*grpc.ClientConn, error) {
+			if atomic.AddInt32(&dials, 1) == 1 {
+				return DialTest(address)
+			}
+			<-release
+			return nil, errors.New("refused")
+		}))
+	require.NoError(t, err)
+	defer p.Close()
+
+	// the notifier doesn't wait for the dials, the notifications meanwhile make one more round.
+	n.notify()
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&dials) == 2 }, time.Second, time.Millisecond)
+	n.notify()
+	n.notify()
+	close(release)
+
+	var dialErr *DialError
+	for i := 0; i < 2; i++ {
+		require.ErrorAs(t, <-errs, &dialErr)
+	}
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&p.(*pool).redialRequests) == 0 }, time.Second, time.Millisecond)
+	require.EqualValues(t, 3, atomic.LoadInt32(&dials))
+	require.EqualValues(t, 2, p.Stats().RedialErrors)
+	require.Equal(t, 1, p.Stats().Current)
+}
+
+func mustParse(t *testing.T, cert tls.Certificate) *x509.Certificate {
+	c, err := x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+	return c
+}
@@ -0,0 +1,208 @@
+// Copyright 2023 chengyayu. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpcpool
+
+import (
+	"context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/stats"
+	"google.golang.org/grpc/status"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ewmaWeight is the weight of the latest sample in the latency moving average.
+const ewmaWeight = 0.2
+
+// baselineRise is how fast the baseline latency follows slower samples,
+// so the baseline recovers after the server becomes slower for good.
+const baselineRise = 0.01
+
+// tracker is the stats.Handler attached to a single physical connection,
+// it observes the RPCs of the connection to count the in-flight ones, estimate its latency
+// and adjust the streams it serves.
+type tracker struct {
+	// atomic, the exponentially weighted moving average of the unary RPC latency in nanoseconds,
+	// zero before the first RPC. keep the int64 fields first to be 64-bit aligned.
+	latency int64
+
+	// atomic, the wire bytes of the messages sent and received.
+	bytesSent     int64
+	bytesReceived int64
+
+	// atomic, unix nano of the last RPC event, zero if none.
+	lastActive int64
+
+	pool *pool
+
+	// atomic, the RPCs started but not ended on the connection.
+	inflight int32
+
+	// atomic, the ended RPCs and the failed ones since the last outlier detection.
+	calls    int32
+	failures int32
+
+	// atomic, the effective streams of the connection, derived from limit.
+	streams int32
+
+	mu sync.Mutex
+	// limit is the AIMD congestion window of the connection.
+	limit float64
+	// baseline is the latency of the connection when it's not congested.
+	baseline time.Duration
+	// cooldown is the number of RPCs to complete before the next decrease,
+	// so one congestion event decreases the limit only once.
+	cooldown int
+}
+
+// rpcInfo is attached to the context of an RPC by TagRPC.
+type rpcInfo struct {
+	stream bool
+}
+
+type rpcInfoKey struct{}
+
+func newTracker(p *pool, streams int) *tracker {
+	return &tracker{pool: p, streams: int32(streams), limit: float64(streams)}
+}
+
+// effective returns the streams the connection serves, at most max.
+func (t *tracker) effective(max int) int {
+	if n := int(atomic.LoadInt32(&t.streams)); n < max {
+		return n
+	}
+	return max
+}
+
+// TagRPC see stats.Handler interface.
+func (t *tracker) TagRPC(ctx context.Context, _ *stats.RPCTagInfo) context.Context {
+	return context.WithValue(ctx, rpcInfoKey{}, &rpcInfo{})
+}
+
+// HandleRPC see stats.Handler interface.
+func (t *tracker) HandleRPC(ctx context.Context, s stats.RPCStats) {
+	info, _ := ctx.Value(rpcInfoKey{}).(*rpcInfo)
+	atomic.StoreInt64(&t.lastActive, time.Now().UnixNano())
+	switch s := s.(type) {
+	case *stats.Begin:
+		if info != nil {
+			info.stream = s.IsClientStream || s.IsServerStream
+		}
+		atomic.AddInt32(&t.inflight, 1)
+		t.pool.inflight.add(procHint(), 1)
+	case *stats.OutPayload:
+		atomic.AddInt64(&t.bytesSent, int64(s.WireLength))
+	case *stats.InPayload:
+		atomic.AddInt64(&t.bytesReceived, int64(s.WireLength))
+	case *stats.End:
+		atomic.AddInt32(&t.inflight, -1)
+		t.pool.inflight.add(procHint(), -1)
+		atomic.AddInt32(&t.calls, 1)
+		if failure(s.Error) {
+			atomic.AddInt32(&t.failures, 1)
+		}
+		latency := s.EndTime.Sub(s.BeginTime)
+		// 流式 RPC 的耗时取决于业务，不计入时延也不作为拥塞信号
+		stream := info != nil && info.stream
+		if !stream {
+			t.record(latency)
+		}
+		if stream && !congested(s.Error) {
+			return
+		}
+		t.observe(latency, s.Error)
+	}
+}
+
+// TagConn see stats.Handler interface.
+func (t *tracker) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+// HandleConn see stats.Handler interface.
+func (t *tracker) HandleConn(context.Context, stats.ConnStats) {}
+
+// reset returns the ended RPCs and the failed ones since the last reset.
+func (t *tracker) reset() (calls, failures int32) {
+	return atomic.SwapInt32(&t.calls, 0), atomic.SwapInt32(&t.failures, 0)
+}
+
+// record adds latency to the moving average.
+func (t *tracker) record(latency time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	avg := atomic.LoadInt64(&t.latency)
+	if avg == 0 {
+		avg = int64(latency)
+	} else {
+		avg += int64(ewmaWeight * float64(int64(latency)-avg))
+	}
+	atomic.StoreInt64(&t.latency, avg)
+}
+
+// observe adjusts the limit by an RPC of latency that failed with err.
+func (t *tracker) observe(latency time.Duration, err error) {
+	o := t.pool.options()
+	if o.adaptiveStreams == 0 {
+		return
+	}
+	max := float64(o.maxConcurrentStreams)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	slow := false
+	if err == nil {
+		if t.baseline == 0 || latency < t.baseline {
+			t.baseline = latency
+		} else {
+			slow = float64(latency) > o.adaptiveStreams*float64(t.baseline)
+			t.baseline += time.Duration(baselineRise * float64(latency-t.baseline))
+		}
+	}
+
+	if t.cooldown > 0 {
+		t.cooldown--
+	}
+	switch {
+	case congested(err) || slow:
+		// 乘性减：每轮拥塞只减半一次
+		if t.cooldown == 0 {
+			t.limit /= 2
+			t.cooldown = int(t.limit) + 1
+		}
+	case err == nil:
+		// 加性增：每个窗口的 RPC 完成后增加 1
+		t.limit += 1 / t.limit
+	}
+	if t.limit > max {
+		t.limit = max
+	}
+	if t.limit < 1 {
+		t.limit = 1
+	}
+	atomic.StoreInt32(&t.streams, int32(t.limit))
+}
+
+// congested reports whether err means the server refused more streams.
+func congested(err error) bool {
+	if err == nil {
+		return false
+	}
+	s := status.Convert(err)
+	return s.Code() == codes.ResourceExhausted ||
+		(s.Code() == codes.Unavailable && strings.Contains(s.Message(), "REFUSED_STREAM"))
+}
@@ -0,0 +1,198 @@
+// Copyright 2023 chengyayu. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpcpool
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTrackerAIMD(t *testing.T) {
+	o := defaultOptions()
+	o.maxConcurrentStreams, o.adaptiveStreams = 8, 2
+	p := &pool{}
+	p.opt.Store(o)
+	tr := newTracker(p, 8)
+
+	// the refused stream halves the streams once per congestion event.
+	tr.observe(time.Millisecond, status.Error(codes.ResourceExhausted, "too many streams"))
+	require.Equal(t, 4, tr.effective(8))
+	tr.observe(time.Millisecond, status.Error(codes.Unavailable, "stream terminated by RST_STREAM with error code: REFUSED_STREAM"))
+	require.Equal(t, 4, tr.effective(8))
+
+	// slow RPCs are congestion as well, after the cooldown of the last decrease.
+	for i := 0; i < 4; i++ {
+		tr.observe(time.Millisecond, nil)
+	}
+	tr.observe(10*time.Millisecond, nil)
+	require.Equal(t, 2, tr.effective(8))
+
+	// the other errors are not.
+	for i := 0; i < 10; i++ {
+		tr.observe(time.Millisecond, status.Error(codes.NotFound, "not found"))
+	}
+	require.Equal(t, 2, tr.effective(8))
+
+	// it increases one per window of RPCs, up to maxConcurrentStreams.
+	for i := 0; i < 100; i++ {
+		tr.observe(time.Millisecond, nil)
+	}
+	require.Equal(t, 8, tr.effective(8))
+	require.Equal(t, 4, tr.effective(4))
+}
+
+func TestAdaptiveStreams(t *testing.T) {
+	var refuse int32 = 1
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	startEchoServer(t, lis, grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if atomic.LoadInt32(&refuse) == 1 {
+			return nil, status.Error(codes.ResourceExhausted, "too many streams")
+		}
+		return handler(ctx, req)
+	}))
+
+	_, err = New(lis.Addr().String(), Dial(DialTest), AdaptiveStreams(2))
+	require.Error(t, err)
+	_, err = New(lis.Addr().String(), AdaptiveStreams(1))
+	require.Error(t, err)
+
+	p, err := New(lis.Addr().String(), MaxIdle(1), MaxActive(4), MaxConcurrentStreams(8), AdaptiveStreams(2))
+	require.NoError(t, err)
+	defer p.Close()
+	require.Equal(t, 8, p.Stats().Capacity)
+
+	conn, err := p.Get()
+	require.NoError(t, err)
+	for i := 0; i < 20; i++ {
+		require.Error(t, say(conn))
+	}
+	require.NoError(t, conn.Close())
+	stats := p.Stats()
+	require.Equal(t, 1, stats.Conns[0].Streams)
+	require.Equal(t, 1, stats.Capacity)
+
+	// the saturated connection makes the pool grow.
+	atomic.StoreInt32(&refuse, 0)
+	conns := make([]Conn, 2)
+	for i := range conns {
+		conns[i], err = p.Get()
+		require.NoError(t, err)
+		defer conns[i].Close()
+	}
+	require.Equal(t, 2, p.Stats().Current)
+	require.NoError(t, say(conns[1]))
+}
+
+func TestTrackerLatency(t *testing.T) {
+	p := &pool{}
+	p.opt.Store(defaultOptions())
+	tr := newTracker(p, 8)
+	tr.record(10 * time.Millisecond)
+	require.EqualValues(t, 10*time.Millisecond, atomic.LoadInt64(&tr.latency))
+	tr.record(20 * time.Millisecond)
+	require.EqualValues(t, 12*time.Millisecond, atomic.LoadInt64(&tr.latency))
+}
+
+func TestFastestPick(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	startEchoServer(t, lis)
+
+	p, err := New(lis.Addr().String(), MaxIdle(2), Pick(FastestPick))
+	require.NoError(t, err)
+	defer p.Close()
+	nativePool := p.(*pool)
+	slow, fast := nativePool.snapshot()[0], nativePool.snapshot()[1]
+	atomic.StoreInt64(&slow.tracker.latency, int64(100*time.Millisecond))
+	atomic.StoreInt64(&fast.tracker.latency, int64(time.Millisecond))
+
+	counts := make(map[*conn]int)
+	for i := 0; i < 200; i++ {
+		borrowed, err := p.Get()
+		require.NoError(t, err)
+		counts[borrowed.(*conn)]++
+		require.NoError(t, borrowed.Close())
+	}
+	// the slow one is borrowed only when it's chosen twice.
+	require.Greater(t, counts[fast], 2*counts[slow])
+
+	// the unary RPCs are measured.
+	borrowed, err := p.Get()
+	require.NoError(t, err)
+	defer borrowed.Close()
+	before := borrowed.(*conn).latency()
+	require.NoError(t, say(borrowed))
+	require.NotEqual(t, before, borrowed.(*conn).latency())
+	require.NotZero(t, p.Stats().Conns[0].Latency)
+
+	_, err = New(lis.Addr().String(), Pick(PickPolicy(-1)))
+	require.Error(t, err)
+}
+
+func TestInFlight(t *testing.T) {
+	release := make(chan struct{})
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	startEchoServer(t, lis, grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		<-release
+		return handler(ctx, req)
+	}))
+
+	p, err := New(lis.Addr().String(), MaxIdle(1), MaxActive(4), MaxConcurrentStreams(2),
+		Shrink(OldestShrink()), MaintainInterval(10*time.Millisecond))
+	require.NoError(t, err)
+	defer p.Close()
+
+	// one borrowed connection carries three RPCs.
+	busy, err := p.Get()
+	require.NoError(t, err)
+	errs := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		go func() { errs <- say(busy) }()
+	}
+	require.Eventually(t, func() bool { return p.Stats().InFlight == 3 }, time.Second, time.Millisecond)
+	require.Equal(t, 3, p.Stats().Conns[0].InFlight)
+
+	// the in-flight RPCs exceed the capacity of one connection, the pool grows.
+	idle, err := p.Get()
+	require.NoError(t, err)
+	require.Equal(t, 2, p.Stats().Current)
+
+	// the oldest connection isn't closed while its RPCs are in flight.
+	require.NoError(t, idle.Close())
+	require.NoError(t, busy.Close())
+	require.Equal(t, 2, p.Stats().Current)
+
+	close(release)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, <-errs)
+	}
+	stats := p.Stats().Conns[0]
+	require.Zero(t, stats.InFlight)
+	require.Positive(t, stats.BytesSent)
+	require.Positive(t, stats.BytesReceived)
+	require.False(t, stats.LastActive.IsZero())
+
+	// the maintenance shrinks it after the RPCs end.
+	require.Eventually(t, func() bool { return p.Stats().Current == 1 }, time.Second, 10*time.Millisecond)
+}